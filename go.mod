@@ -5,7 +5,6 @@ go 1.21
 require (
 	github.com/evanw/esbuild v0.23.1
 	github.com/fsnotify/fsnotify v1.7.0
-	github.com/go-stack/stack v1.8.1
 	github.com/rs/zerolog v1.33.0
 	github.com/spf13/cobra v1.8.1
 	github.com/stretchr/testify v1.10.0
@@ -63,12 +63,10 @@ func RunServer() *jobs.Job {
 	ActiveServerPort = serverResult.Port
 	logger.Info().Msgf("EsBuild server running at %d", ActiveServerPort)
 
-	go func() {
+	return job.Run(func(job *jobs.Job) error {
 		<-job.Canceled()
 		logger.Info().Msg("Shutting down esbuild server and watcher")
 		esCtx.Dispose()
-		job.Finish()
-	}()
-
-	return job
+		return nil
+	})
 }
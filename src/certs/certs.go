@@ -0,0 +1,174 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"hsf/src/ee"
+	"hsf/src/jobs"
+	"hsf/src/logging"
+	"math/big"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+/*
+ * Most deployments put a reverse proxy in front of the website and let it
+ * handle TLS. For those that don't, this package lets the website serve TLS
+ * itself. The certificate and key are loaded from disk and watched for
+ * changes, so that renewed certificates (e.g. from certbot) are picked up
+ * without restarting the server.
+ */
+
+// Holds the current certificate and swaps it out when the files on disk
+// change. Plug GetCertificate into a tls.Config.
+type Reloader struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+// Loads the certificate and key. Fails if they cannot be loaded, since there's
+// no point starting a TLS server without them.
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reloads the certificate and key from disk. If they fail to load, the
+// previous certificate stays in use.
+func (r *Reloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return ee.New(err, "failed to load TLS certificate %s and key %s", r.certFile, r.keyFile)
+	}
+	r.cert.Store(&cert)
+	return nil
+}
+
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// Watches the certificate and key files for changes and reloads them. The
+// containing directories are watched rather than the files themselves, since
+// tools like certbot replace certificates by swapping symlinks.
+func (r *Reloader) Watch() *jobs.Job {
+	job := jobs.New("TLS certificate watcher")
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logging.Error().Err(err).Msg("Failed to watch TLS certificates; they will not be reloaded")
+		return job.Finish()
+	}
+
+	watchedNames := map[string]bool{}
+	for _, filename := range []string{r.certFile, r.keyFile} {
+		abs, err := filepath.Abs(filename)
+		if err != nil {
+			abs = filename
+		}
+		watchedNames[abs] = true
+		if err := watcher.Add(filepath.Dir(abs)); err != nil {
+			logging.Error().Err(err).Str("Dir", filepath.Dir(abs)).Msg("Failed to watch TLS certificate directory")
+		}
+	}
+
+	// Certificate renewals usually touch several files in quick succession
+	// (cert, key, chain), so we wait for things to settle before reloading.
+	debouncer := time.NewTimer(time.Minute)
+	debouncer.Stop()
+	debouncerRunning := false
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event := <-watcher.Events:
+				if !watchedNames[event.Name] {
+					continue
+				}
+				if !debouncer.Stop() && debouncerRunning {
+					<-debouncer.C
+				}
+				debouncerRunning = true
+				debouncer.Reset(time.Second)
+			case err := <-watcher.Errors:
+				logging.Error().Err(err).Msg("Error watching TLS certificates")
+			case <-debouncer.C:
+				debouncerRunning = false
+				if err := r.Reload(); err != nil {
+					logging.Error().Err(err).Msg("Failed to reload TLS certificate; keeping the old one")
+				} else {
+					logging.Info().Str("Cert", r.certFile).Msg("Reloaded TLS certificate")
+				}
+			case <-job.Canceled():
+				logging.Info().Msg("Shutting down TLS certificate watcher")
+				job.Finish()
+				return
+			}
+		}
+	}()
+
+	return job
+}
+
+// Generates a self-signed certificate and key, PEM-encoded, valid for the
+// given host names and IP addresses. For local development only.
+func GenerateSelfSigned(hosts []string, validFor time.Duration) (certPEM []byte, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, ee.New(err, "failed to generate private key")
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, ee.New(err, "failed to generate serial number")
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"HSF local development"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, ee.New(err, "failed to create certificate")
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, ee.New(err, "failed to marshal private key")
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
@@ -0,0 +1,41 @@
+package certs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	writeCert := func() {
+		certPEM, keyPEM, err := GenerateSelfSigned([]string{"localhost", "127.0.0.1"}, time.Hour)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(certFile, certPEM, 0o644))
+		require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+	}
+
+	writeCert()
+	r, err := NewReloader(certFile, keyFile)
+	require.NoError(t, err)
+	first, _ := r.GetCertificate(nil)
+	assert.Equal(t, []string{"localhost"}, first.Leaf.DNSNames)
+
+	writeCert()
+	require.NoError(t, r.Reload())
+	second, _ := r.GetCertificate(nil)
+	assert.NotEqual(t, first.Leaf.SerialNumber, second.Leaf.SerialNumber)
+
+	// A broken file must not replace a working certificate
+	require.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0o600))
+	assert.Error(t, r.Reload())
+	third, _ := r.GetCertificate(nil)
+	assert.Same(t, second, third)
+}
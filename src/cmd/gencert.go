@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"fmt"
+	"hsf/src/certs"
+	"hsf/src/logging"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var genCertCommand = &cobra.Command{
+	Use:   "gencert",
+	Short: "Generate a self-signed TLS certificate for local development",
+	Run: func(cmd *cobra.Command, args []string) {
+		certFile, _ := cmd.Flags().GetString("cert")
+		keyFile, _ := cmd.Flags().GetString("key")
+		hosts, _ := cmd.Flags().GetStringSlice("host")
+
+		certPEM, keyPEM, err := certs.GenerateSelfSigned(hosts, 365*24*time.Hour)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		for _, dir := range []string{filepath.Dir(certFile), filepath.Dir(keyFile)} {
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		if err := os.WriteFile(certFile, certPEM, 0o644); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		logging.Info().
+			Str("Cert", certFile).
+			Str("Key", keyFile).
+			Strs("Hosts", hosts).
+			Msg("Wrote self-signed certificate; set config.TLS to use it")
+	},
+}
+
+func init() {
+	genCertCommand.Flags().String("cert", "devcert/cert.pem", "Where to write the certificate")
+	genCertCommand.Flags().String("key", "devcert/key.pem", "Where to write the private key")
+	genCertCommand.Flags().StringSlice("host", []string{"localhost", "127.0.0.1", "::1"}, "Host names and IPs the certificate is valid for")
+	rootCmd.AddCommand(genCertCommand)
+}
@@ -1,6 +1,12 @@
 package config
 
-import "github.com/rs/zerolog"
+import (
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/rs/zerolog"
+)
 
 /*
  * Most web frameworks allow you to define config files in a text format like
@@ -23,11 +29,262 @@ const (
 
 type Cfg struct {
 	Env           Environment
-	WebserverAddr string
+	WebserverAddr string // host:port, or unix:/path/to/socket
 	LogLevel      zerolog.Level
+	LogFormat     LogFormat
+
+	// Overrides LogLevel for loggers with a matching "module" field, e.g.
+	// {"EsBuild": zerolog.WarnLevel}.
+	LogModuleLevels map[string]zerolog.Level
+
+	LogFile     LogFileConfig
+	LogSampling LogSamplingConfig
+
+	// How many recent log entries to keep in memory for the admin server's
+	// log viewer. Defaults to 1000; set to -1 to disable.
+	LogRecentEntries int
+
+	// Stack frames whose function starts with one of these are left out of
+	// stack traces. Defaults to runtime and net/http frames; set to an empty
+	// slice to keep everything.
+	LogStackTrimPrefixes []string
+
 	EsBuild       EsBuildConfig
+	RequestLimits RequestLimitsConfig
+	HTTPServer    HTTPServerConfig
+	TLS           TLSConfig
+	Shutdown      ShutdownConfig
+	Admin         AdminConfig
+	AccessLog     AccessLogConfig
+	ErrorReports  ErrorReportsConfig
+}
+
+type LogFormat string
+
+const (
+	LogFormatPretty LogFormat = "pretty" // Human-readable, colored if stderr is a terminal
+	LogFormatJSON   LogFormat = "json"   // One JSON object per line, for log collectors
+)
+
+// Leaving LogFormat empty uses pretty logs in Dev and JSON everywhere else.
+func (f LogFormat) OrDefault(env Environment) LogFormat {
+	if f != "" {
+		return f
+	}
+	if env == Dev {
+		return LogFormatPretty
+	}
+	return LogFormatJSON
+}
+
+// Writes logs to a file as JSON, in addition to stderr. Leave Path empty to
+// disable. Rotated files are named after the original with a timestamp, e.g.
+// logs/hsf-2024-03-05T14-07-09.000.log. To use logrotate instead, leave
+// MaxSize and RotateEvery unset and send SIGHUP after rotating.
+type LogFileConfig struct {
+	Path        string
+	MaxSize     int64         // Rotate once the file reaches this many bytes; 0 for no limit
+	RotateEvery time.Duration // e.g. 24 * time.Hour to rotate at midnight UTC; 0 to disable
+	MaxBackups  int           // Rotated files to keep; 0 keeps all
+	MaxAge      time.Duration // Delete rotated files older than this; 0 keeps all
+	Compress    bool          // Gzip rotated files
+
+	// Log lines waiting to be written. When full, lines are dropped rather
+	// than making requests wait on a slow disk. Defaults to 4096.
+	BufferSize int
+}
+
+func (c LogFileConfig) WithDefaults() LogFileConfig {
+	if c.BufferSize == 0 {
+		c.BufferSize = 4096
+	}
+	return c
+}
+
+// Limits how often the same message can be logged. Within each Window, a
+// message (at a given level) is logged at most Burst times; the rest are
+// counted and summarized in a single warning at the end of the window. A
+// negative burst means no limit.
+//
+// Warnings and errors are never sampled unless LevelBursts says otherwise,
+// and neither is the access log.
+type LogSamplingConfig struct {
+	Window        time.Duration         // Defaults to 10 seconds
+	Burst         int                   // Defaults to 20
+	LevelBursts   map[zerolog.Level]int // Overrides Burst by level
+	MessageBursts map[string]int        // Overrides Burst by exact message
+}
+
+func (c LogSamplingConfig) WithDefaults() LogSamplingConfig {
+	if c.Window == 0 {
+		c.Window = 10 * time.Second
+	}
+	if c.Burst == 0 {
+		c.Burst = 20
+	}
+
+	levelBursts := make(map[zerolog.Level]int, len(c.LevelBursts)+3)
+	for _, level := range []zerolog.Level{zerolog.WarnLevel, zerolog.ErrorLevel, zerolog.PanicLevel} {
+		levelBursts[level] = -1
+	}
+	for level, burst := range c.LevelBursts {
+		levelBursts[level] = burst
+	}
+	c.LevelBursts = levelBursts
+	return c
 }
 
 type EsBuildConfig struct {
 	Port uint16
 }
+
+// Default limits applied to every route by WebsiteRoutes. Zero means no limit.
+type RequestLimitsConfig struct {
+	Timeout     time.Duration // How long a handler may run before a 503 page is shown
+	MaxBodySize int64         // In bytes
+}
+
+// Settings for the website's http.Server. Zero values are replaced with the
+// defaults for the current environment; see WithDefaults.
+type HTTPServerConfig struct {
+	ReadHeaderTimeout time.Duration // Guards against slowloris-style attacks
+	ReadTimeout       time.Duration // Includes the body; zero means no limit, so slow uploads can finish
+	WriteTimeout      time.Duration // Zero means no limit, so large downloads can finish
+	IdleTimeout       time.Duration // How long to keep idle keep-alive connections
+	MaxHeaderBytes    int
+	UnixSocketMode    os.FileMode // Permissions for unix: addresses
+}
+
+// Fills in any unset fields with safe defaults. Dev is more lenient so that you
+// can poke at the server by hand (e.g. with telnet) without being cut off.
+func (c HTTPServerConfig) WithDefaults(env Environment) HTTPServerConfig {
+	if c.ReadHeaderTimeout == 0 {
+		if env == Dev {
+			c.ReadHeaderTimeout = time.Minute
+		} else {
+			c.ReadHeaderTimeout = 10 * time.Second
+		}
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = 2 * time.Minute
+	}
+	if c.MaxHeaderBytes == 0 {
+		c.MaxHeaderBytes = 64 << 10 // 64 KiB
+	}
+	if c.UnixSocketMode == 0 {
+		c.UnixSocketMode = 0o660 // Owner and group, e.g. a reverse proxy
+	}
+	return c
+}
+
+// Lets the website serve HTTPS itself, for deployments without a reverse
+// proxy. TLS is enabled when CertFile and KeyFile are set, in which case
+// WebserverAddr serves HTTPS. The files are reloaded automatically when they
+// change. Run `go run . gencert` to make a self-signed certificate for Dev.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+
+	// Minimum TLS version, e.g. tls.VersionTLS12. Defaults to TLS 1.2.
+	MinVersion uint16
+
+	// If set, a plain HTTP listener on this address redirects everything to
+	// HTTPS, e.g. "0.0.0.0:80".
+	RedirectAddr string
+}
+
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+// How long each phase of a graceful shutdown may take before the remaining
+// work is abandoned. See website/shutdown.go for the phases. Zero values use
+// a default of 10 seconds.
+type ShutdownConfig struct {
+	LongRunningRequestsTimeout time.Duration
+	HTTPDrainTimeout           time.Duration
+	JobsTimeout                time.Duration
+}
+
+func (c ShutdownConfig) WithDefaults() ShutdownConfig {
+	const defaultTimeout = 10 * time.Second
+	if c.LongRunningRequestsTimeout == 0 {
+		c.LongRunningRequestsTimeout = defaultTimeout
+	}
+	if c.HTTPDrainTimeout == 0 {
+		c.HTTPDrainTimeout = defaultTimeout
+	}
+	if c.JobsTimeout == 0 {
+		c.JobsTimeout = defaultTimeout
+	}
+	return c
+}
+
+// The admin server provides health checks, profiling, and a status page on a
+// separate listener. It is unauthenticated, so keep it bound to localhost or a
+// private network. Leave Addr empty to disable it.
+type AdminConfig struct {
+	Addr string
+}
+
+type AccessLogFormat string
+
+const (
+	AccessLogCombined AccessLogFormat = "combined" // Apache/nginx Combined Log Format
+	AccessLogJSON     AccessLogFormat = "json"     // One JSON object per line
+)
+
+// One entry is logged per request. Sensitive parts of URLs are redacted
+// before they are logged, in both the request path and the Referer.
+type AccessLogConfig struct {
+	// Where to write the access log. Empty sends entries to the application
+	// log as structured fields, "-" writes to stdout, and anything else is a
+	// file to append to.
+	File string
+
+	// The format for File. Defaults to AccessLogCombined.
+	Format AccessLogFormat
+
+	// Query parameters whose values are replaced with "REDACTED", matched
+	// case-insensitively. Nil uses DefaultRedactQueryParams; use an empty
+	// slice to redact nothing.
+	RedactQueryParams []string
+
+	// Patterns matched against the URL path. The text matched by each capture
+	// group is replaced with "REDACTED", e.g. `^/reset-password/([^/]+)`.
+	RedactPaths []*regexp.Regexp
+}
+
+var DefaultRedactQueryParams = []string{
+	"password", "token", "access_token", "secret", "key", "api_key", "code", "session",
+}
+
+func (c AccessLogConfig) WithDefaults() AccessLogConfig {
+	if c.Format == "" {
+		c.Format = AccessLogCombined
+	}
+	if c.RedactQueryParams == nil {
+		c.RedactQueryParams = DefaultRedactQueryParams
+	}
+	return c
+}
+
+// Where to send reports about internal server errors. Each sink is enabled by
+// filling in its settings. Errors are grouped and rate limited; see
+// src/errreport.
+type ErrorReportsConfig struct {
+	Email   EmailReportsConfig
+	Webhook string // URL to POST JSON reports to
+	File    string // File to append JSON reports to
+
+	NotifyInterval          time.Duration // Between reports of the same error; defaults to 10 minutes
+	MaxNotificationsPerHour int           // Across all errors; defaults to 30
+}
+
+// Sends email through an SMTP server without authentication, e.g. a local
+// Postfix.
+type EmailReportsConfig struct {
+	SMTPAddr string // e.g. "localhost:25"
+	From     string
+	To       []string
+}
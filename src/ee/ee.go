@@ -1,9 +1,11 @@
 package ee
 
 import (
+	"encoding/json"
 	"fmt"
+	"runtime"
+	"strings"
 
-	"github.com/go-stack/stack"
 	"github.com/rs/zerolog"
 )
 
@@ -18,7 +20,8 @@ import (
  * stack trace, so as to provide a clear chain of causation.
  *
  * The ee.Error type implements the Unwrap() interface introduced in Go 1.13,
- * allowing the use of errors.Is and errors.As.
+ * allowing the use of errors.Is and errors.As. To return several errors at
+ * once, see Join in multi.go.
  *
  * This error type is intended for "exceptions", not for simple error values
  * like io.EOF that do not merit a stack trace. There is no shame in using a
@@ -30,20 +33,27 @@ type Error struct {
 	Message string
 	Wrapped error
 	Stack   CallStack
+
+	// Optional extras; see kinds.go.
+	Kind        Kind
+	Context     map[string]any // Details for the logs, e.g. IDs
+	UserMessage string         // Safe to show to the user, unlike Message
 }
 
 func New(wrapped error, format string, args ...interface{}) error {
 	return &Error{
 		Message: fmt.Sprintf(format, args...),
 		Wrapped: wrapped,
-		Stack:   Trace()[1:], // NOTE(asaf): Remove the call to New from the stack
+		Stack:   TraceSkip(1), // NOTE(asaf): Remove the call to New from the stack
 	}
 }
 
 var _ error = &Error{}
 
 func (e *Error) Error() string {
-	if e.Wrapped == nil {
+	if e.Message == "" && e.Wrapped != nil {
+		return e.Wrapped.Error()
+	} else if e.Wrapped == nil {
 		return e.Message
 	} else {
 		return fmt.Sprintf("%s: %v", e.Message, e.Wrapped)
@@ -54,14 +64,64 @@ func (e *Error) Unwrap() error {
 	return e.Wrapped
 }
 
-type CallStack []StackFrame
+// A stack trace, captured as raw program counters. Resolving them to
+// functions, files and lines is comparatively slow, so it is only done when
+// needed: when the stack is logged, marshaled, or Frames is called.
+type CallStack []uintptr
+
+// The deepest stack we capture. Anything deeper is cut off.
+const maxStackDepth = 100
+
+// Frames with functions starting with any of these prefixes are left out of
+// stack traces, since they are rarely interesting and can be very long. Set
+// from config.Config.LogStackTrimPrefixes by the logging package.
+var TrimPrefixes = []string{"runtime.", "net/http."}
+
+func (s CallStack) Frames() []StackFrame {
+	if len(s) == 0 {
+		return nil
+	}
+	frames := runtime.CallersFrames(s)
+	res := make([]StackFrame, 0, len(s))
+	for {
+		frame, more := frames.Next()
+		if !isTrimmed(frame.Function) {
+			res = append(res, StackFrame{
+				File:     frame.File,
+				Line:     frame.Line,
+				Function: frame.Function,
+			})
+		}
+		if !more {
+			break
+		}
+	}
+	return res
+}
+
+func isTrimmed(function string) bool {
+	for _, prefix := range TrimPrefixes {
+		if strings.HasPrefix(function, prefix) {
+			return true
+		}
+	}
+	return false
+}
 
 func (s CallStack) MarshalZerologArray(a *zerolog.Array) {
-	for _, frame := range s {
+	for _, frame := range s.Frames() {
 		a.Object(frame)
 	}
 }
 
+func (s CallStack) MarshalJSON() ([]byte, error) {
+	frames := s.Frames()
+	if frames == nil {
+		frames = []StackFrame{}
+	}
+	return json.Marshal(frames)
+}
+
 type StackFrame struct {
 	File     string `json:"file"`
 	Line     int    `json:"line"`
@@ -75,26 +135,33 @@ func (f StackFrame) MarshalZerologObject(e *zerolog.Event) {
 		Str("function", f.Function)
 }
 
+// Logs the deepest ee stack in the error, or for multi-errors, each
+// sub-error's message and stack (see MultiStack).
 var ZerologStackMarshaler = func(err error) interface{} {
-	if asEE, ok := err.(*Error); ok {
-		return asEE.Stack
+	if errs := Errors(err); errs != nil {
+		stacks := make(MultiStack, len(errs))
+		for i, sub := range errs {
+			stacks[i] = ErrorStack{Error: sub.Error(), Stack: StackOf(sub)}
+		}
+		return stacks
+	}
+	if stack := StackOf(err); stack != nil {
+		return stack
 	}
 	// NOTE(asaf): If we got here, it means zerolog is trying to output a non-EE error.
 	//			       We remove this call and the zerolog caller from the stack.
-	return Trace()[2:]
+	return TraceSkip(2)
 }
 
+// Captures the stack of the caller.
 func Trace() CallStack {
-	trace := stack.Trace().TrimRuntime()[1:]
-	frames := make(CallStack, len(trace))
-	for i, call := range trace {
-		callFrame := call.Frame()
-		frames[i] = StackFrame{
-			File:     callFrame.File,
-			Line:     callFrame.Line,
-			Function: callFrame.Function,
-		}
-	}
+	return TraceSkip(1)
+}
 
-	return frames
+// Captures the stack of the caller, leaving out skip more frames, e.g. 1 to
+// start at the caller's caller.
+func TraceSkip(skip int) CallStack {
+	var pcs [maxStackDepth]uintptr
+	n := runtime.Callers(skip+2, pcs[:]) // Skip runtime.Callers and TraceSkip
+	return append(CallStack(nil), pcs[:n]...)
 }
@@ -0,0 +1,76 @@
+package ee
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrace(t *testing.T) {
+	err := New(nil, "oops").(*Error)
+	frames := err.Stack.Frames()
+	require.NotEmpty(t, frames)
+	assert.Equal(t, "hsf/src/ee.TestTrace", frames[0].Function)
+	assert.True(t, strings.HasSuffix(frames[0].File, "ee_test.go"))
+
+	encoded, jsonErr := json.Marshal(err.Stack)
+	require.NoError(t, jsonErr)
+	assert.Contains(t, string(encoded), `"function":"hsf/src/ee.TestTrace"`)
+
+	var empty CallStack
+	encoded, _ = json.Marshal(empty)
+	assert.Equal(t, "[]", string(encoded))
+}
+
+func TestTrimPrefixes(t *testing.T) {
+	var stack CallStack
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stack = Trace()
+	})
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	hasPrefix := func(frames []StackFrame, prefix string) bool {
+		for _, frame := range frames {
+			if strings.HasPrefix(frame.Function, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	assert.False(t, hasPrefix(stack.Frames(), "net/http."))
+	assert.False(t, hasPrefix(stack.Frames(), "runtime."))
+
+	defer func(prefixes []string) { TrimPrefixes = prefixes }(TrimPrefixes)
+	TrimPrefixes = nil
+	assert.True(t, hasPrefix(stack.Frames(), "net/http."))
+}
+
+func deepError(depth int) error {
+	if depth == 0 {
+		return New(nil, "deep")
+	}
+	return deepError(depth - 1)
+}
+
+func BenchmarkNew(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		_ = deepError(20)
+	}
+}
+
+func BenchmarkNewAndFrames(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		_ = deepError(20).(*Error).Stack.Frames()
+	}
+}
+
+func BenchmarkNewAndLogJSON(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		_, _ = json.Marshal(deepError(20).(*Error).Stack)
+	}
+}
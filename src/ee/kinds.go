@@ -0,0 +1,152 @@
+package ee
+
+import (
+	"fmt"
+)
+
+/*
+ * An ee.Error can optionally say what kind of failure it is, carry key/value
+ * context for the logs, and carry a message that is safe to show to users.
+ * These let code far from the request handler decide how an error should be
+ * presented, e.g.:
+ *
+ *   return ee.WithKind(ee.New(err, "no user with id %d", id), ee.KindNotFound)
+ *
+ * The With* functions add to the outermost ee.Error in place of creating a
+ * new layer, and wrap anything else in a new ee.Error. The *Of functions
+ * search the whole chain, and the outermost setting wins.
+ *
+ * Message and Context are for developers and may contain anything, so they
+ * should only ever end up in logs. Only UserMessage should be shown to users.
+ */
+
+type Kind int
+
+const (
+	KindUnknown Kind = iota // Nothing more specific is known; usually an internal error
+	KindNotFound
+	KindForbidden
+	KindInvalid
+	KindConflict
+	KindUnavailable
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindUnknown:
+		return "unknown"
+	case KindNotFound:
+		return "not found"
+	case KindForbidden:
+		return "forbidden"
+	case KindInvalid:
+		return "invalid"
+	case KindConflict:
+		return "conflict"
+	case KindUnavailable:
+		return "unavailable"
+	default:
+		return fmt.Sprintf("Kind(%d)", int(k))
+	}
+}
+
+// Returns err as an *Error that can be modified without affecting anyone
+// else holding err.
+func modifiable(err error) *Error {
+	if asEE, ok := err.(*Error); ok {
+		copied := *asEE
+		return &copied
+	}
+	return &Error{
+		Wrapped: err,
+		Stack:   TraceSkip(2), // Remove this function and the With* caller
+	}
+}
+
+func WithKind(err error, kind Kind) error {
+	if err == nil {
+		return nil
+	}
+	res := modifiable(err)
+	res.Kind = kind
+	return res
+}
+
+// Adds key/value pairs to the error's context, e.g.
+// ee.WithContext(err, "UserID", id, "Path", path). Keys must be strings.
+func WithContext(err error, keyvals ...any) error {
+	if err == nil {
+		return nil
+	}
+	if len(keyvals)%2 != 0 {
+		panic("ee.WithContext needs an even number of arguments")
+	}
+	res := modifiable(err)
+	context := make(map[string]any, len(res.Context)+len(keyvals)/2)
+	for k, v := range res.Context {
+		context[k] = v
+	}
+	for i := 0; i < len(keyvals); i += 2 {
+		context[keyvals[i].(string)] = keyvals[i+1]
+	}
+	res.Context = context
+	return res
+}
+
+func WithUserMessage(err error, format string, args ...any) error {
+	if err == nil {
+		return nil
+	}
+	res := modifiable(err)
+	res.UserMessage = fmt.Sprintf(format, args...)
+	return res
+}
+
+// Calls f for each ee.Error in the chain, outermost first, until f returns
+// false. The sub-errors of multi-errors are searched in order.
+func walk(err error, f func(e *Error) bool) {
+	visit(err, func(err error, depth int) bool {
+		if asEE, ok := err.(*Error); ok {
+			return f(asEE)
+		}
+		return true
+	})
+}
+
+// Returns the kind of the outermost ee.Error that has one.
+func KindOf(err error) Kind {
+	kind := KindUnknown
+	walk(err, func(e *Error) bool {
+		kind = e.Kind
+		return kind == KindUnknown
+	})
+	return kind
+}
+
+// Returns the user message of the outermost ee.Error that has one, or "".
+func UserMessageOf(err error) string {
+	var msg string
+	walk(err, func(e *Error) bool {
+		msg = e.UserMessage
+		return msg == ""
+	})
+	return msg
+}
+
+// Returns the context of every ee.Error in the chain, merged. Where keys
+// clash, outer errors win. Returns nil if there is no context.
+func ContextOf(err error) map[string]any {
+	var res map[string]any
+	walk(err, func(e *Error) bool {
+		for k, v := range e.Context {
+			if res == nil {
+				res = make(map[string]any)
+			}
+			if _, ok := res[k]; !ok {
+				res[k] = v
+			}
+		}
+		return true
+	})
+	return res
+}
@@ -0,0 +1,34 @@
+package ee
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKindsAndContext(t *testing.T) {
+	inner := WithContext(WithKind(New(nil, "no user 12"), KindNotFound), "UserID", 12, "Source", "db")
+	outer := WithUserMessage(WithContext(New(inner, "failed to load profile"), "Source", "profile"), "That user doesn't exist.")
+
+	assert.Equal(t, KindNotFound, KindOf(outer))
+	assert.Equal(t, "That user doesn't exist.", UserMessageOf(outer))
+	assert.Equal(t, map[string]any{"UserID": 12, "Source": "profile"}, ContextOf(outer))
+	assert.Equal(t, "failed to load profile: no user 12", outer.Error())
+
+	// The outermost kind wins
+	assert.Equal(t, KindConflict, KindOf(WithKind(outer, KindConflict)))
+	assert.Equal(t, KindNotFound, KindOf(outer))
+
+	// Other errors are wrapped, without changing the message
+	wrapped := WithKind(io.EOF, KindInvalid)
+	assert.Equal(t, "EOF", wrapped.Error())
+	assert.True(t, errors.Is(wrapped, io.EOF))
+	assert.Equal(t, KindInvalid, KindOf(wrapped))
+	assert.Equal(t, "ee.TestKindsAndContext", wrapped.(*Error).Stack.Frames()[0].Function[len("hsf/src/"):])
+
+	assert.Equal(t, KindUnknown, KindOf(io.EOF))
+	assert.Nil(t, ContextOf(io.EOF))
+	assert.Nil(t, WithKind(nil, KindNotFound))
+}
@@ -0,0 +1,129 @@
+package ee
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*
+ * Sometimes several things fail at once: a form with several invalid
+ * fields, or several servers failing to shut down. MultiError holds all of
+ * those errors, each with its own stack trace, in place of keeping only the
+ * first one. It works with errors.Is and errors.As like errors.Join does,
+ * and the functions in this package (KindOf, StackOf, etc.) search every
+ * sub-error, as well as those of errors created with errors.Join.
+ */
+
+type MultiError struct {
+	Errors []error
+	Stack  CallStack // Where the errors were joined
+}
+
+// Combines errors into one, discarding nils. Returns nil if there are no
+// errors left, and the error itself if there is only one.
+func Join(errs ...error) error {
+	var nonNil []error
+	for _, err := range errs {
+		if err != nil {
+			nonNil = append(nonNil, err)
+		}
+	}
+	switch len(nonNil) {
+	case 0:
+		return nil
+	case 1:
+		return nonNil[0]
+	default:
+		return &MultiError{
+			Errors: nonNil,
+			Stack:  TraceSkip(1), // Remove the call to Join from the stack
+		}
+	}
+}
+
+var _ error = &MultiError{}
+
+func (m *MultiError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d errors:", len(m.Errors))
+	for _, err := range m.Errors {
+		b.WriteString("\n  - ")
+		b.WriteString(strings.ReplaceAll(err.Error(), "\n", "\n    "))
+	}
+	return b.String()
+}
+
+func (m *MultiError) Unwrap() []error {
+	return m.Errors
+}
+
+// Calls f for err and everything it wraps, depth first, until f returns
+// false. Both single wrapping (Unwrap() error) and multiple wrapping
+// (Unwrap() []error, as with errors.Join) are followed. depth counts the
+// wrapping levels above each error.
+func visit(err error, f func(err error, depth int) bool) bool {
+	return visitDepth(err, 0, f)
+}
+
+func visitDepth(err error, depth int, f func(err error, depth int) bool) bool {
+	if err == nil {
+		return true
+	}
+	if !f(err, depth) {
+		return false
+	}
+	switch wrapper := err.(type) {
+	case interface{ Unwrap() error }:
+		return visitDepth(wrapper.Unwrap(), depth+1, f)
+	case interface{ Unwrap() []error }:
+		for _, sub := range wrapper.Unwrap() {
+			if !visitDepth(sub, depth+1, f) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Returns the errors that make up err, if err is or wraps a multi-error
+// (either a MultiError or one from errors.Join). Otherwise returns nil.
+func Errors(err error) []error {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if multi, ok := err.(interface{ Unwrap() []error }); ok {
+			return multi.Unwrap()
+		}
+	}
+	return nil
+}
+
+// Returns the stack of the deepest ee.Error (or MultiError) found anywhere
+// in err, since that is closest to the cause. Returns nil if there is none.
+func StackOf(err error) CallStack {
+	var stack CallStack
+	deepest := -1
+	visit(err, func(err error, depth int) bool {
+		var s CallStack
+		switch e := err.(type) {
+		case *Error:
+			s = e.Stack
+		case *MultiError:
+			s = e.Stack
+		}
+		if s != nil && depth > deepest {
+			stack = s
+			deepest = depth
+		}
+		return true
+	})
+	return stack
+}
+
+// The stack traces of the errors in a multi-error, as logged in place of a
+// single stack.
+type MultiStack []ErrorStack
+
+type ErrorStack struct {
+	Error string    `json:"error"`
+	Stack CallStack `json:"stack,omitempty"`
+}
@@ -0,0 +1,54 @@
+package ee
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJoin(t *testing.T) {
+	assert.Nil(t, Join(nil, nil))
+	assert.Equal(t, io.EOF, Join(nil, io.EOF))
+
+	first := WithKind(New(nil, "name is required"), KindInvalid)
+	second := New(io.ErrUnexpectedEOF, "failed to read body")
+	joined := Join(first, nil, second)
+
+	assert.Equal(t, "2 errors:\n  - name is required\n  - failed to read body: unexpected EOF", joined.Error())
+	assert.ErrorIs(t, joined, io.ErrUnexpectedEOF)
+	assert.Equal(t, KindInvalid, KindOf(joined))
+	assert.Equal(t, []error{first, second}, Errors(fmt.Errorf("validation: %w", joined)))
+	assert.Nil(t, Errors(first))
+}
+
+func TestStackOf(t *testing.T) {
+	inner := New(nil, "inner")
+	outer := New(fmt.Errorf("context: %w", inner), "outer")
+	assert.Equal(t, inner.(*Error).Stack, StackOf(outer))
+	assert.Equal(t, inner.(*Error).Stack, StackOf(fmt.Errorf("wrapped: %w", inner)))
+	assert.Equal(t, inner.(*Error).Stack, StackOf(errors.Join(io.EOF, inner)))
+	assert.Nil(t, StackOf(io.EOF))
+}
+
+func TestZerologStackMarshaler(t *testing.T) {
+	inner := New(nil, "inner")
+	stack := ZerologStackMarshaler(fmt.Errorf("wrapped: %w", inner))
+	assert.Equal(t, inner.(*Error).Stack, stack)
+
+	multi := ZerologStackMarshaler(Join(inner, io.EOF))
+	encoded, err := json.Marshal(multi)
+	require.NoError(t, err)
+	var decoded []map[string]any
+	require.NoError(t, json.Unmarshal(encoded, &decoded))
+	require.Len(t, decoded, 2)
+	assert.Equal(t, "inner", decoded[0]["error"])
+	assert.NotEmpty(t, decoded[0]["stack"])
+	assert.Equal(t, "EOF", decoded[1]["error"])
+	assert.Nil(t, decoded[1]["stack"])
+
+}
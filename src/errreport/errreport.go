@@ -0,0 +1,266 @@
+package errreport
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"hsf/src/config"
+	"hsf/src/ee"
+	"hsf/src/jobs"
+	"hsf/src/logging"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+/*
+ * Logging an error is only useful if someone reads the logs. This package
+ * makes sure someone finds out: errors passed to Report are grouped by
+ * fingerprint, and each group sends a notification to the configured sinks
+ * (email, webhook, file) when it first appears.
+ *
+ * The fingerprint is made from the error's stack trace and message, with
+ * numbers blanked out so that "user 12 not found" and "user 34 not found"
+ * count as the same error. Repeats of a group are counted but only notified
+ * again once NotifyInterval has passed, and notifications across all groups
+ * are capped per hour, so that an error in a hot loop can't flood your inbox.
+ *
+ * Notifications are sent in the background by the job returned from Start;
+ * Report itself never blocks.
+ */
+
+type Group struct {
+	Fingerprint string
+	Message     string
+	Stack       []ee.StackFrame
+	Count       int
+	FirstSeen   time.Time
+	LastSeen    time.Time
+	Context     map[string]string // From the most recent occurrence
+
+	lastNotified time.Time
+	notifiedAt   int // Count at the last notification
+}
+
+// A notification about a group, sent to sinks.
+type Notification struct {
+	Group
+	NewOccurrences int // Since the last notification
+}
+
+type Sink interface {
+	Name() string
+	Send(n Notification) error
+}
+
+type Options struct {
+	NotifyInterval          time.Duration // Minimum time between notifications for one group
+	MaxNotificationsPerHour int           // Across all groups
+	MaxGroups               int           // The least recently seen groups are forgotten
+}
+
+type Reporter struct {
+	opts  Options
+	sinks []Sink
+
+	mu     sync.Mutex
+	groups map[string]*Group
+	sent   []time.Time // Notifications in the last hour, for rate limiting
+
+	queue chan Notification
+}
+
+func NewReporter(opts Options, sinks ...Sink) *Reporter {
+	if opts.NotifyInterval == 0 {
+		opts.NotifyInterval = 10 * time.Minute
+	}
+	if opts.MaxNotificationsPerHour == 0 {
+		opts.MaxNotificationsPerHour = 30
+	}
+	if opts.MaxGroups == 0 {
+		opts.MaxGroups = 1000
+	}
+	return &Reporter{
+		opts:   opts,
+		sinks:  sinks,
+		groups: make(map[string]*Group),
+		queue:  make(chan Notification, 100),
+	}
+}
+
+// Creates a reporter with the sinks enabled in the config.
+func NewFromConfig(cfg config.ErrorReportsConfig) *Reporter {
+	var sinks []Sink
+	if cfg.Email.SMTPAddr != "" && len(cfg.Email.To) > 0 {
+		sinks = append(sinks, &EmailSink{Addr: cfg.Email.SMTPAddr, From: cfg.Email.From, To: cfg.Email.To})
+	}
+	if cfg.Webhook != "" {
+		sinks = append(sinks, &WebhookSink{Url: cfg.Webhook})
+	}
+	if cfg.File != "" {
+		sinks = append(sinks, &FileSink{Path: cfg.File})
+	}
+	return NewReporter(Options{
+		NotifyInterval:          cfg.NotifyInterval,
+		MaxNotificationsPerHour: cfg.MaxNotificationsPerHour,
+	}, sinks...)
+}
+
+// The reporter used by Report. Errors are grouped but not sent anywhere until
+// it is replaced, e.g. by website.Start.
+var Default = NewReporter(Options{})
+
+// Reports an error to the default reporter. The context describes where the
+// error happened, e.g. the request URL.
+func Report(err error, context map[string]string) {
+	Default.Report(err, context)
+}
+
+func (r *Reporter) Report(err error, context map[string]string) {
+	if err == nil {
+		return
+	}
+	now := time.Now()
+	fingerprint, stack := Fingerprint(err)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	g, ok := r.groups[fingerprint]
+	if !ok {
+		r.evictIfFull()
+		g = &Group{
+			Fingerprint: fingerprint,
+			Stack:       stack,
+			FirstSeen:   now,
+		}
+		r.groups[fingerprint] = g
+	}
+	g.Count++
+	g.LastSeen = now
+	g.Message = err.Error()
+	g.Context = context
+
+	if len(r.sinks) == 0 || now.Sub(g.lastNotified) < r.opts.NotifyInterval {
+		return
+	}
+	if !r.takeNotificationSlot(now) {
+		return // Will be notified on a later occurrence, with the full count
+	}
+
+	n := Notification{Group: *g, NewOccurrences: g.Count - g.notifiedAt}
+	g.lastNotified = now
+	g.notifiedAt = g.Count
+
+	select {
+	case r.queue <- n:
+	default:
+		logging.Warn().Str("Fingerprint", fingerprint).Msg("Error report queue is full; dropping notification")
+	}
+}
+
+// Must be called with r.mu held.
+func (r *Reporter) takeNotificationSlot(now time.Time) bool {
+	cutoff := now.Add(-time.Hour)
+	r.sent = slices.DeleteFunc(r.sent, func(t time.Time) bool { return t.Before(cutoff) })
+	if len(r.sent) >= r.opts.MaxNotificationsPerHour {
+		return false
+	}
+	r.sent = append(r.sent, now)
+	return true
+}
+
+// Must be called with r.mu held.
+func (r *Reporter) evictIfFull() {
+	if len(r.groups) < r.opts.MaxGroups {
+		return
+	}
+	var oldest *Group
+	for _, g := range r.groups {
+		if oldest == nil || g.LastSeen.Before(oldest.LastSeen) {
+			oldest = g
+		}
+	}
+	delete(r.groups, oldest.Fingerprint)
+}
+
+// Returns all groups, most recently seen first.
+func (r *Reporter) Groups() []Group {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	groups := make([]Group, 0, len(r.groups))
+	for _, g := range r.groups {
+		groups = append(groups, *g)
+	}
+	slices.SortFunc(groups, func(a, b Group) int {
+		return b.LastSeen.Compare(a.LastSeen)
+	})
+	return groups
+}
+
+// Sends notifications in the background until the job is canceled. Anything
+// already queued is sent before the job finishes.
+func (r *Reporter) Start() *jobs.Job {
+	return jobs.Go("Error reporter", func(job *jobs.Job) error {
+		for {
+			select {
+			case n := <-r.queue:
+				r.send(n)
+			case <-job.Canceled():
+				for {
+					select {
+					case n := <-r.queue:
+						r.send(n)
+					default:
+						return nil
+					}
+				}
+			}
+		}
+	})
+}
+
+func (r *Reporter) send(n Notification) {
+	for _, sink := range r.sinks {
+		r.sendTo(sink, n)
+	}
+}
+
+// Sends to a single sink, so that a sink that panics doesn't stop the others
+// from being notified.
+func (r *Reporter) sendTo(sink Sink, n Notification) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			logger := logging.With().Str("Sink", sink.Name()).Logger()
+			logging.LogPanicValue(&logger, recovered, "Error report sink panicked")
+		}
+	}()
+
+	if err := sink.Send(n); err != nil {
+		// Not logged as an error, or we might end up reporting our own
+		// failure to report.
+		logging.Warn().Err(err).Str("Sink", sink.Name()).Msg("Failed to send error report")
+	}
+}
+
+var numberRegex = regexp.MustCompile(`[0-9]+`)
+
+// Identifies an error by where it came from and what it says. The stack is
+// taken from the deepest ee.Error, which is closest to the cause. Line
+// numbers are left out so that unrelated edits to a file don't split
+// groups.
+func Fingerprint(err error) (string, []ee.StackFrame) {
+	stack := ee.StackOf(err).Frames()
+
+	h := sha1.New()
+	for _, frame := range stack {
+		h.Write([]byte(frame.Function))
+		h.Write([]byte{0})
+		h.Write([]byte(frame.File))
+		h.Write([]byte{0})
+	}
+	h.Write([]byte(numberRegex.ReplaceAllString(err.Error(), "N")))
+
+	return hex.EncodeToString(h.Sum(nil))[:16], stack
+}
@@ -0,0 +1,137 @@
+package errreport
+
+import (
+	"encoding/json"
+	"errors"
+	"hsf/src/ee"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSink struct {
+	mu   sync.Mutex
+	sent []Notification
+}
+
+func (s *fakeSink) Name() string { return "fake" }
+
+func (s *fakeSink) Send(n Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, n)
+	return nil
+}
+
+func (s *fakeSink) Sent() []Notification {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Notification(nil), s.sent...)
+}
+
+func failUser(id int) error {
+	return ee.New(nil, "user %d not found", id)
+}
+
+func TestFingerprint(t *testing.T) {
+	a, _ := Fingerprint(failUser(12))
+	b, _ := Fingerprint(failUser(345))
+	assert.Equal(t, a, b, "numbers should not affect the fingerprint")
+
+	c, _ := Fingerprint(ee.New(nil, "user %d not found", 12))
+	assert.NotEqual(t, a, c, "different stacks should have different fingerprints")
+
+	wrapped, stack := Fingerprint(ee.New(failUser(1), "wrapped"))
+	assert.NotEqual(t, a, wrapped)
+	assert.Equal(t, "hsf/src/errreport.failUser", stack[0].Function, "should use the innermost stack")
+}
+
+func TestReporterGroupsAndRateLimits(t *testing.T) {
+	sink := &fakeSink{}
+	r := NewReporter(Options{NotifyInterval: time.Hour, MaxNotificationsPerHour: 2}, sink)
+	job := r.Start()
+
+	for i := 0; i < 5; i++ {
+		r.Report(failUser(i), map[string]string{"Path": "/users"})
+	}
+	r.Report(errors.New("something else"), nil)
+	r.Report(errors.New("a third thing"), nil) // Over the hourly limit
+
+	job.Cancel()
+	<-job.Finished()
+
+	groups := r.Groups()
+	assert.Len(t, groups, 3)
+	counts := map[string]int{}
+	for _, g := range groups {
+		counts[g.Message] = g.Count
+	}
+	assert.Equal(t, 5, counts["user 4 not found"])
+
+	sent := sink.Sent()
+	assert.Len(t, sent, 2)
+	assert.Equal(t, "user 0 not found", sent[0].Message)
+	assert.Equal(t, 1, sent[0].NewOccurrences)
+	assert.Equal(t, "something else", sent[1].Message)
+}
+
+type panickySink struct{}
+
+func (panickySink) Name() string { return "panicky" }
+
+func (panickySink) Send(n Notification) error {
+	panic("sink exploded")
+}
+
+func TestReporterSurvivesPanickingSink(t *testing.T) {
+	sink := &fakeSink{}
+	r := NewReporter(Options{}, panickySink{}, sink)
+	job := r.Start()
+
+	r.Report(errors.New("boom"), nil)
+	r.Report(errors.New("again"), nil)
+	job.Cancel()
+	<-job.Finished()
+
+	sent := sink.Sent()
+	assert.Len(t, sent, 2)
+	assert.Equal(t, "boom", sent[0].Message)
+	assert.Equal(t, "again", sent[1].Message)
+}
+
+func TestWebhookAndFileSinks(t *testing.T) {
+	n := Notification{
+		Group: Group{
+			Fingerprint: "abc",
+			Message:     "boom",
+			Count:       3,
+			Stack:       []ee.StackFrame{{File: "main.go", Line: 1, Function: "main.main"}},
+		},
+		NewOccurrences: 2,
+	}
+
+	var received map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer server.Close()
+	assert.Nil(t, (&WebhookSink{Url: server.URL}).Send(n))
+	assert.Equal(t, "boom", received["message"])
+	assert.Equal(t, float64(2), received["new_occurrences"])
+
+	path := filepath.Join(t.TempDir(), "errors.jsonl")
+	sink := &FileSink{Path: path}
+	assert.Nil(t, sink.Send(n))
+	assert.Nil(t, sink.Send(n))
+	contents, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Contains(t, string(contents), `"fingerprint":"abc"`)
+	assert.Len(t, strings.Split(strings.TrimSpace(string(contents)), "\n"), 2)
+}
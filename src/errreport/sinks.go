@@ -0,0 +1,174 @@
+package errreport
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hsf/src/ee"
+	"io"
+	"net/http"
+	"net/smtp"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A plain-text description of a notification, shared by the sinks that need
+// one.
+func (n Notification) Subject() string {
+	msg := n.Message
+	if i := strings.IndexByte(msg, '\n'); i >= 0 {
+		msg = msg[:i]
+	}
+	if len(msg) > 100 {
+		msg = msg[:100] + "..."
+	}
+	return "[hsf] " + msg
+}
+
+func (n Notification) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n\n", n.Message)
+	fmt.Fprintf(&b, "Occurrences: %d (%d since the last report)\n", n.Count, n.NewOccurrences)
+	fmt.Fprintf(&b, "First seen:  %s\n", n.FirstSeen.Format(time.RFC3339))
+	fmt.Fprintf(&b, "Last seen:   %s\n", n.LastSeen.Format(time.RFC3339))
+	fmt.Fprintf(&b, "Fingerprint: %s\n", n.Fingerprint)
+
+	if len(n.Context) > 0 {
+		b.WriteString("\nContext:\n")
+		keys := make([]string, 0, len(n.Context))
+		for k := range n.Context {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&b, "  %s: %s\n", k, n.Context[k])
+		}
+	}
+
+	if len(n.Stack) > 0 {
+		b.WriteString("\nStack trace:\n")
+		for _, frame := range n.Stack {
+			fmt.Fprintf(&b, "  %s (%s:%d)\n", frame.Function, frame.File, frame.Line)
+		}
+	}
+	return b.String()
+}
+
+type notificationJSON struct {
+	Fingerprint    string            `json:"fingerprint"`
+	Message        string            `json:"message"`
+	Count          int               `json:"count"`
+	NewOccurrences int               `json:"new_occurrences"`
+	FirstSeen      time.Time         `json:"first_seen"`
+	LastSeen       time.Time         `json:"last_seen"`
+	Context        map[string]string `json:"context,omitempty"`
+	Stack          []ee.StackFrame   `json:"stack,omitempty"`
+}
+
+func (n Notification) MarshalJSON() ([]byte, error) {
+	return json.Marshal(notificationJSON{
+		Fingerprint:    n.Fingerprint,
+		Message:        n.Message,
+		Count:          n.Count,
+		NewOccurrences: n.NewOccurrences,
+		FirstSeen:      n.FirstSeen,
+		LastSeen:       n.LastSeen,
+		Context:        n.Context,
+		Stack:          n.Stack,
+	})
+}
+
+// Sends email through an SMTP server that doesn't need authentication,
+// typically a local mailer like Postfix on localhost:25.
+type EmailSink struct {
+	Addr string
+	From string
+	To   []string
+}
+
+func (s *EmailSink) Name() string {
+	return "email"
+}
+
+func (s *EmailSink) Send(n Notification) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", strings.NewReplacer("\r", " ", "\n", " ").Replace(n.Subject()))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(n.Text(), "\n", "\r\n"))
+
+	if err := smtp.SendMail(s.Addr, nil, s.From, s.To, msg.Bytes()); err != nil {
+		return ee.New(err, "failed to send error report email via %s", s.Addr)
+	}
+	return nil
+}
+
+// POSTs each notification as JSON to a URL.
+type WebhookSink struct {
+	Url    string
+	Client *http.Client // Defaults to a client with a 10 second timeout
+}
+
+func (s *WebhookSink) Name() string {
+	return "webhook"
+}
+
+func (s *WebhookSink) Send(n Notification) error {
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	body, err := json.Marshal(n)
+	if err != nil {
+		return ee.New(err, "failed to encode error report")
+	}
+	res, err := client.Post(s.Url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return ee.New(err, "failed to send error report to webhook")
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode >= 300 {
+		return ee.New(nil, "error report webhook responded with %s", res.Status)
+	}
+	return nil
+}
+
+// Appends each notification to a file as a line of JSON.
+type FileSink struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func (s *FileSink) Name() string {
+	return "file"
+}
+
+func (s *FileSink) Send(n Notification) error {
+	line, err := json.Marshal(n)
+	if err != nil {
+		return ee.New(err, "failed to encode error report")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return ee.New(err, "failed to open error report file %s", s.Path)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return ee.New(err, "failed to write error report file %s", s.Path)
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package jobs
 
 import (
 	"context"
+	"sync"
 	"time"
 )
 
@@ -20,6 +21,17 @@ type Job struct {
 	Ctx    context.Context
 	cancel func()
 	done   chan struct{}
+
+	finishOnce sync.Once
+	mu         sync.Mutex
+	err        error
+
+	// Set when supervised by Run; see run.go.
+	phase         State
+	restarts      int
+	lastErr       error
+	onStateChange func(job *Job, from, to State)
+	transitionMu  sync.Mutex // Keeps state changes and their callbacks in order
 }
 
 func New(name string) *Job {
@@ -36,7 +48,7 @@ func New(name string) *Job {
 // and shut down. Internally, this cancels the Job's context. Expected to be
 // called from outside the job, e.g. when shutting down the application.
 func (j *Job) Cancel() {
-	j.cancel()
+	j.transition(j.cancel)
 }
 
 // Returns a channel that can be waited on to receive a Cancel signal from
@@ -48,10 +60,31 @@ func (j *Job) Canceled() <-chan struct{} {
 // Marks the Job as finished, indicating that its work is completely done.
 // Expected to be called internally by the job code when the work is complete.
 func (j *Job) Finish() *Job {
-	close(j.done)
+	j.finishOnce.Do(func() {
+		close(j.done)
+	})
 	return j
 }
 
+// Records that the Job has failed, and cancels it so that the rest of its
+// work stops too. The Job still needs to Finish as usual. Only the first
+// error is kept.
+func (j *Job) Fail(err error) {
+	j.mu.Lock()
+	if j.err == nil {
+		j.err = err
+	}
+	j.mu.Unlock()
+	j.cancel()
+}
+
+// Returns the error the Job failed with, if any.
+func (j *Job) Err() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.err
+}
+
 // Returns a channel that can be waited on to tell when the Job is finished
 // (that is, when Finish() has been called). Expected to be used outside the
 // job to tell when work is complete.
@@ -59,6 +92,40 @@ func (j *Job) Finished() <-chan struct{} {
 	return j.done
 }
 
+type State string
+
+const (
+	StateStarting   State = "starting"   // Started, but not Ready yet (see RunOptions.WaitForReady)
+	StateRunning    State = "running"    // Doing its work
+	StateRestarting State = "restarting" // Waiting to be restarted (see RunOptions.Restart)
+	StateCanceling  State = "canceling"  // Canceled, but not finished yet
+	StateFinished   State = "finished"   // Completely done, i.e. stopped
+	StateFailed     State = "failed"     // Done, but with an error (see Fail)
+)
+
+// All states a Job can be in, in order.
+var States = []State{StateStarting, StateRunning, StateRestarting, StateCanceling, StateFinished, StateFailed}
+
+func (j *Job) State() State {
+	select {
+	case <-j.done:
+		if j.Err() != nil {
+			return StateFailed
+		}
+		return StateFinished
+	default:
+	}
+	if j.Ctx.Err() != nil {
+		return StateCanceling
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.phase != "" {
+		return j.phase
+	}
+	return StateRunning
+}
+
 // A utility for running and canceling multiple jobs at once. Because this type
 // is simply a slice of Jobs, you can construct it using normal slice syntax.
 type Jobs []*Job
@@ -41,3 +41,12 @@ func FakeJob(name string, timeout time.Duration) *Job {
 	}()
 	return job
 }
+
+func TestJobState(t *testing.T) {
+	job := New("Job")
+	assert.Equal(t, StateRunning, job.State())
+	job.Cancel()
+	assert.Equal(t, StateCanceling, job.State())
+	job.Finish()
+	assert.Equal(t, StateFinished, job.State())
+}
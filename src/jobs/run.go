@@ -0,0 +1,280 @@
+package jobs
+
+import (
+	"hsf/src/ee"
+	"hsf/src/logging"
+	"math/rand"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+/*
+ * A panic in a goroutine takes down the whole process, no matter who started
+ * the goroutine. Run and Go start goroutines that recover from panics
+ * instead: the panic is logged, and the Job fails with it as its error (see
+ * Fail and Err).
+ *
+ * Run also supervises the job's function: depending on RunOptions.Restart,
+ * it can be run again when it fails or returns. Restarts back off
+ * exponentially, with jitter so that jobs that failed together don't all
+ * retry at the same moment, and the backoff resets once a run has lasted
+ * StableAfter. While this happens, the Job goes through these states:
+ *
+ *   starting -> running -> restarting -> starting -> ... -> finished/failed
+ *
+ * (starting only lasts until the job calls Ready, and only if
+ * RunOptions.WaitForReady is set. Cancel moves the Job to canceling from any
+ * state before it finishes.) A run that fails and is restarted does not make
+ * the Job failed; see LastError for why it was restarted. Use State, Restarts
+ * and LastError, or RunOptions.OnStateChange, to follow along.
+ */
+
+type RestartPolicy int
+
+const (
+	RestartNever     RestartPolicy = iota // Finish or fail when the function returns
+	RestartOnFailure                      // Run again if the function returns an error or panics
+	RestartAlways                         // Run again whenever the function returns, until canceled
+)
+
+type RunOptions struct {
+	Restart RestartPolicy
+
+	// The delay before the first restart, which doubles with each restart in
+	// a row up to MaxRestartDelay. Defaults to 1 second and 1 minute. Each
+	// delay is randomly varied by up to 20% either way.
+	RestartDelay    time.Duration
+	MaxRestartDelay time.Duration
+
+	// A run that lasts at least this long resets the backoff and restart
+	// count. Defaults to 1 minute.
+	StableAfter time.Duration
+
+	// Give up (and fail) after this many restarts in a row. 0 means never
+	// give up.
+	MaxRestarts int
+
+	// Keep the job in StateStarting until it calls Ready, e.g. once a server
+	// is listening.
+	WaitForReady bool
+
+	// Called on every state change, usually from the supervising goroutine
+	// (or from Cancel). Calls are made one at a time and in order, so this
+	// must not cancel the job or call Ready itself.
+	OnStateChange func(job *Job, from, to State)
+}
+
+func (o RunOptions) withDefaults() RunOptions {
+	if o.RestartDelay == 0 {
+		o.RestartDelay = time.Second
+	}
+	if o.MaxRestartDelay == 0 {
+		o.MaxRestartDelay = time.Minute
+	}
+	if o.StableAfter == 0 {
+		o.StableAfter = time.Minute
+	}
+	return o
+}
+
+// Creates a Job and runs f as its work. See Run.
+func Go(name string, f func(job *Job) error) *Job {
+	return New(name).Run(f)
+}
+
+// Runs f in a new goroutine as the Job's work. The Job finishes when f
+// returns, and fails if f returns an error or panics. f should return once
+// the Job is canceled.
+func (j *Job) Run(f func(job *Job) error) *Job {
+	return j.RunWithOptions(RunOptions{}, f)
+}
+
+// Like Run, but with restarts; see RunOptions.
+func (j *Job) RunWithOptions(opts RunOptions, f func(job *Job) error) *Job {
+	opts = opts.withDefaults()
+	runPhase := StateRunning
+	if opts.WaitForReady {
+		runPhase = StateStarting
+	}
+
+	// The Job starts out in the state of its first run, without announcing it.
+	j.mu.Lock()
+	j.onStateChange = opts.OnStateChange
+	j.phase = runPhase
+	j.mu.Unlock()
+
+	go func() {
+		err := j.supervise(opts, runPhase, f)
+
+		j.transitionMu.Lock()
+		defer j.transitionMu.Unlock()
+		from := j.State()
+		if err != nil {
+			j.Fail(err)
+		}
+		to := StateFinished
+		if j.Err() != nil {
+			to = StateFailed
+		}
+		// Announce the final state before finishing, so that anyone waiting
+		// on Finished has seen every state change.
+		j.notifyStateChange(from, to)
+		j.Finish()
+	}()
+	return j
+}
+
+// Runs f until the restart policy says to stop, and returns the error the
+// Job should fail with, if any.
+func (j *Job) supervise(opts RunOptions, runPhase State, f func(job *Job) error) error {
+	inARow := 0
+	for {
+		j.setPhase(runPhase)
+
+		started := time.Now()
+		err := j.runRecovering(func() error { return f(j) })
+		if err != nil {
+			j.mu.Lock()
+			j.lastErr = err
+			j.mu.Unlock()
+		}
+		if time.Since(started) >= opts.StableAfter {
+			inARow = 0
+		}
+
+		restart := opts.Restart == RestartAlways || opts.Restart == RestartOnFailure && err != nil
+		if !restart || j.Ctx.Err() != nil {
+			return err
+		}
+
+		logger := j.logger()
+		if opts.MaxRestarts > 0 && inARow >= opts.MaxRestarts {
+			logger.Error().Int("Restarts", inARow).Msg("Job restarted too many times; giving up")
+			if err == nil {
+				err = ee.New(nil, "job %q restarted too many times", j.Name)
+			}
+			return err
+		}
+
+		delay := restartDelay(opts, inARow)
+		inARow++
+		j.setPhase(StateRestarting)
+		logger.Info().Dur("Delay", delay).Int("Restarts", inARow).Msg("Restarting job")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-j.Canceled():
+			timer.Stop()
+			return err
+		}
+
+		j.mu.Lock()
+		j.restarts++
+		j.mu.Unlock()
+	}
+}
+
+// The backoff before restart number n+1 in a row.
+func restartDelay(opts RunOptions, n int) time.Duration {
+	delay := opts.RestartDelay
+	for i := 0; i < n && delay < opts.MaxRestartDelay; i++ {
+		delay *= 2
+	}
+	if delay > opts.MaxRestartDelay {
+		delay = opts.MaxRestartDelay
+	}
+	jitter := 0.8 + 0.4*rand.Float64()
+	return time.Duration(float64(delay) * jitter)
+}
+
+// Marks a job started with RunOptions.WaitForReady as running.
+func (j *Job) Ready() {
+	j.mu.Lock()
+	starting := j.phase == StateStarting
+	j.mu.Unlock()
+	if starting {
+		j.setPhase(StateRunning)
+	}
+}
+
+// The number of times the job's function has been restarted.
+func (j *Job) Restarts() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.restarts
+}
+
+// Returns the most recent error the job's function failed with, even if it
+// has been restarted since. See Err for the error the Job itself failed
+// with.
+func (j *Job) LastError() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.lastErr
+}
+
+func (j *Job) setPhase(phase State) {
+	j.transition(func() {
+		j.mu.Lock()
+		j.phase = phase
+		j.mu.Unlock()
+	})
+}
+
+// Makes a change to the Job and calls OnStateChange if its state changed.
+func (j *Job) transition(change func()) {
+	j.transitionMu.Lock()
+	defer j.transitionMu.Unlock()
+
+	from := j.State()
+	change()
+	j.notifyStateChange(from, j.State())
+}
+
+func (j *Job) notifyStateChange(from, to State) {
+	j.mu.Lock()
+	onStateChange := j.onStateChange
+	j.mu.Unlock()
+	if from != to && onStateChange != nil {
+		onStateChange(j, from, to)
+	}
+}
+
+// Runs f in a new goroutine alongside the Job's main work, e.g. a helper
+// that waits for something on the Job's behalf. If f returns an error or
+// panics, the Job fails, which also cancels it. f returning does not finish
+// the Job.
+func (j *Job) Go(f func() error) {
+	go func() {
+		if err := j.runRecovering(f); err != nil {
+			j.Fail(err)
+		}
+	}()
+}
+
+// Runs f, logging and returning any error it returns or panic it raises.
+func (j *Job) runRecovering(f func() error) (err error) {
+	logger := j.logger()
+	defer func() {
+		if r := recover(); r != nil {
+			logging.LogPanicValue(&logger, r, "Job panicked")
+			if panicErr, ok := r.(error); ok {
+				err = ee.New(panicErr, "job %q panicked", j.Name)
+			} else {
+				err = ee.New(nil, "job %q panicked: %v", j.Name, r)
+			}
+		}
+	}()
+
+	err = f()
+	if err != nil {
+		logger.Error().Err(err).Msg("Job failed")
+	}
+	return err
+}
+
+func (j *Job) logger() zerolog.Logger {
+	return logging.ExtractLogger(j.Ctx).With().Timestamp().Str("Job", j.Name).Logger()
+}
@@ -0,0 +1,161 @@
+package jobs
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func waitFinished(t *testing.T, job *Job) {
+	t.Helper()
+	select {
+	case <-job.Finished():
+	case <-time.After(5 * time.Second):
+		t.Fatal("job did not finish")
+	}
+}
+
+func TestRun(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		job := Go("Job", func(job *Job) error { return nil })
+		waitFinished(t, job)
+		assert.Equal(t, StateFinished, job.State())
+		assert.NoError(t, job.Err())
+	})
+	t.Run("error", func(t *testing.T) {
+		job := Go("Job", func(job *Job) error { return errors.New("oops") })
+		waitFinished(t, job)
+		assert.Equal(t, StateFailed, job.State())
+		assert.EqualError(t, job.Err(), "oops")
+	})
+	t.Run("panic", func(t *testing.T) {
+		job := Go("Job", func(job *Job) error { panic("boom") })
+		waitFinished(t, job)
+		assert.Equal(t, StateFailed, job.State())
+		assert.EqualError(t, job.Err(), `job "Job" panicked: boom`)
+	})
+	t.Run("restart", func(t *testing.T) {
+		var runs atomic.Int32
+		job := New("Job").RunWithOptions(RunOptions{Restart: RestartOnFailure, RestartDelay: time.Millisecond}, func(job *Job) error {
+			if runs.Add(1) < 3 {
+				panic("not yet")
+			}
+			<-job.Canceled()
+			return nil
+		})
+		require.Eventually(t, func() bool { return runs.Load() == 3 }, 5*time.Second, time.Millisecond)
+		assert.Equal(t, StateRunning, job.State())
+
+		job.Cancel()
+		waitFinished(t, job)
+		assert.Equal(t, StateFinished, job.State())
+	})
+	t.Run("helper goroutine", func(t *testing.T) {
+		job := Go("Job", func(job *Job) error {
+			job.Go(func() error { panic(errors.New("helper broke")) })
+			<-job.Canceled()
+			return nil
+		})
+		waitFinished(t, job)
+		assert.Equal(t, StateFailed, job.State())
+		assert.ErrorContains(t, job.Err(), "helper broke")
+	})
+}
+
+func TestSupervise(t *testing.T) {
+	t.Run("backoff", func(t *testing.T) {
+		opts := RunOptions{RestartDelay: time.Second, MaxRestartDelay: 10 * time.Second}.withDefaults()
+		for n, expected := range []time.Duration{1, 2, 4, 8, 10, 10} {
+			delay := restartDelay(opts, n)
+			assert.GreaterOrEqual(t, delay, expected*time.Second*8/10, n)
+			assert.LessOrEqual(t, delay, expected*time.Second*12/10, n)
+		}
+	})
+	t.Run("gives up", func(t *testing.T) {
+		var runs atomic.Int32
+		var transitions []string
+		job := New("Job").RunWithOptions(RunOptions{
+			Restart:      RestartOnFailure,
+			RestartDelay: time.Millisecond,
+			MaxRestarts:  2,
+			OnStateChange: func(job *Job, from, to State) {
+				transitions = append(transitions, string(from)+"->"+string(to))
+			},
+		}, func(job *Job) error {
+			runs.Add(1)
+			return errors.New("still broken")
+		})
+		waitFinished(t, job)
+		assert.Equal(t, StateFailed, job.State())
+		assert.EqualValues(t, 3, runs.Load())
+		assert.Equal(t, 2, job.Restarts())
+		assert.EqualError(t, job.Err(), "still broken")
+		assert.Equal(t, []string{
+			"running->restarting", "restarting->running",
+			"running->restarting", "restarting->running",
+			"running->failed",
+		}, transitions)
+	})
+	t.Run("restart always", func(t *testing.T) {
+		var runs atomic.Int32
+		job := New("Job").RunWithOptions(RunOptions{
+			Restart:      RestartAlways,
+			RestartDelay: time.Millisecond,
+		}, func(job *Job) error {
+			runs.Add(1)
+			return nil
+		})
+		require.Eventually(t, func() bool { return runs.Load() >= 3 }, 5*time.Second, time.Millisecond)
+		job.Cancel()
+		waitFinished(t, job)
+		assert.Equal(t, StateFinished, job.State())
+		assert.NoError(t, job.LastError())
+	})
+	t.Run("state changes", func(t *testing.T) {
+		var mu sync.Mutex
+		var transitions []string
+		ready := make(chan struct{})
+		failed := false
+		job := New("Job").RunWithOptions(RunOptions{
+			Restart:      RestartOnFailure,
+			RestartDelay: time.Millisecond,
+			WaitForReady: true,
+			OnStateChange: func(job *Job, from, to State) {
+				mu.Lock()
+				defer mu.Unlock()
+				transitions = append(transitions, string(from)+"->"+string(to))
+			},
+		}, func(job *Job) error {
+			if !failed {
+				failed = true
+				return errors.New("first run fails")
+			}
+			<-ready
+			job.Ready()
+			<-job.Canceled()
+			return nil
+		})
+
+		require.Eventually(t, func() bool { return job.State() == StateStarting && job.Restarts() == 1 }, 5*time.Second, time.Millisecond)
+		assert.EqualError(t, job.LastError(), "first run fails")
+		close(ready)
+		require.Eventually(t, func() bool { return job.State() == StateRunning }, 5*time.Second, time.Millisecond)
+		job.Cancel()
+		waitFinished(t, job)
+
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, []string{
+			"starting->restarting",
+			"restarting->starting",
+			"starting->running",
+			"running->canceling",
+			"canceling->finished",
+		}, transitions)
+	})
+}
@@ -0,0 +1,131 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Writes log lines to another writer in the background, so that a slow disk
+// can't stall the goroutines doing the logging. Lines are queued in a buffer;
+// if the buffer fills up, new lines are dropped, and a note saying how many
+// were lost is written once things catch up.
+//
+// The note is a JSON log line, so only use this for JSON output.
+type AsyncWriter struct {
+	out     io.Writer
+	lines   chan []byte
+	flushes chan chan struct{}
+	dropped atomic.Int64
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	done      chan struct{}
+}
+
+var _ io.WriteCloser = &AsyncWriter{}
+
+// Creates an AsyncWriter that buffers up to bufferSize lines.
+func NewAsyncWriter(out io.Writer, bufferSize int) *AsyncWriter {
+	w := &AsyncWriter{
+		out:     out,
+		lines:   make(chan []byte, bufferSize),
+		flushes: make(chan chan struct{}),
+		closed:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *AsyncWriter) Write(p []byte) (int, error) {
+	// The caller may reuse p (zerolog does), so we need our own copy
+	line := make([]byte, len(p))
+	copy(line, p)
+
+	select {
+	case w.lines <- line:
+	default:
+		w.dropped.Add(1)
+	}
+	return len(p), nil
+}
+
+// Waits until everything written so far has been passed on, or until the
+// timeout expires.
+func (w *AsyncWriter) Flush(timeout time.Duration) {
+	done := make(chan struct{})
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case w.flushes <- done:
+	case <-w.done:
+		return
+	case <-timer.C:
+		return
+	}
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+}
+
+// Flushes and stops the background goroutine. Later writes are dropped.
+// Does not close the underlying writer.
+func (w *AsyncWriter) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.closed)
+	})
+	<-w.done
+	return nil
+}
+
+// The number of lines dropped so far because the buffer was full.
+func (w *AsyncWriter) Dropped() int64 {
+	return w.dropped.Load()
+}
+
+func (w *AsyncWriter) run() {
+	defer close(w.done)
+
+	var reportedDropped int64
+	write := func(line []byte) {
+		if _, err := w.out.Write(line); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write log: %v\n", err)
+		}
+		if dropped := w.dropped.Load(); dropped > reportedDropped {
+			fmt.Fprintf(w.out,
+				`{"level":"warn","time":%q,"message":"Dropped log messages because the log writer could not keep up","Dropped":%d}`+"\n",
+				time.Now().Format(time.RFC3339), dropped-reportedDropped,
+			)
+			reportedDropped = dropped
+		}
+	}
+	drain := func() {
+		for {
+			select {
+			case line := <-w.lines:
+				write(line)
+			default:
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case line := <-w.lines:
+			write(line)
+		case done := <-w.flushes:
+			drain()
+			close(done)
+		case <-w.closed:
+			drain()
+			return
+		}
+	}
+}
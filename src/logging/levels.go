@@ -0,0 +1,86 @@
+package logging
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/rs/zerolog"
+)
+
+/*
+ * Log levels can be set per module, e.g. to see debug logs from EsBuild
+ * without the noise from everything else. A module is whatever a logger's
+ * "module" field says:
+ *
+ *   logger := logging.With().Str("module", "EsBuild").Logger()
+ *
+ * Levels are configured with config.Config.LogModuleLevels; everything else
+ * uses config.Config.LogLevel. zerolog's global level is set to the lowest of
+ * these, so that events are only built if some module wants them, and the
+ * rest of the filtering happens here when the event is written.
+ */
+
+const ModuleFieldName = "module"
+
+type moduleLevelFilter struct {
+	out          io.Writer
+	defaultLevel zerolog.Level
+	moduleLevels map[string]zerolog.Level
+}
+
+var _ zerolog.LevelWriter = &moduleLevelFilter{}
+
+func newModuleLevelFilter(out io.Writer, defaultLevel zerolog.Level, moduleLevels map[string]zerolog.Level) *moduleLevelFilter {
+	return &moduleLevelFilter{
+		out:          out,
+		defaultLevel: defaultLevel,
+		moduleLevels: moduleLevels,
+	}
+}
+
+// The lowest level that any module logs at.
+func (f *moduleLevelFilter) MinLevel() zerolog.Level {
+	min := f.defaultLevel
+	for _, level := range f.moduleLevels {
+		if level < min {
+			min = level
+		}
+	}
+	return min
+}
+
+func (f *moduleLevelFilter) Write(p []byte) (int, error) {
+	return f.out.Write(p)
+}
+
+func (f *moduleLevelFilter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	minLevel := f.defaultLevel
+	if len(f.moduleLevels) > 0 {
+		if moduleLevel, ok := f.moduleLevels[moduleOf(p)]; ok {
+			minLevel = moduleLevel
+		}
+	}
+	if level < minLevel && level != zerolog.NoLevel {
+		// Pretend we wrote it; zerolog reports short writes as errors.
+		return len(p), nil
+	}
+	return f.out.Write(p)
+}
+
+var moduleFieldPrefix = []byte(`"` + ModuleFieldName + `":"`)
+
+// Finds the module field in an encoded event without decoding the whole
+// thing. Quotes inside string values are escaped, so the prefix can only
+// match an actual field.
+func moduleOf(event []byte) string {
+	i := bytes.Index(event, moduleFieldPrefix)
+	if i < 0 {
+		return ""
+	}
+	rest := event[i+len(moduleFieldPrefix):]
+	end := bytes.IndexByte(rest, '"')
+	if end < 0 {
+		return ""
+	}
+	return string(rest[:end])
+}
@@ -0,0 +1,34 @@
+package logging
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModuleLevelFilter(t *testing.T) {
+	var out strings.Builder
+	filter := newModuleLevelFilter(&out, zerolog.InfoLevel, map[string]zerolog.Level{
+		"EsBuild": zerolog.WarnLevel,
+		"http":    zerolog.DebugLevel,
+	})
+	assert.Equal(t, zerolog.DebugLevel, filter.MinLevel())
+
+	logger := zerolog.New(filter).Level(filter.MinLevel())
+	logger.Debug().Msg("default debug")
+	logger.Info().Msg("default info")
+	logger.Info().Str("module", "EsBuild").Msg("esbuild info")
+	logger.Warn().Str("module", "EsBuild").Msg("esbuild warn")
+	logger.Debug().Str("module", "http").Msg("http debug")
+	logger.Debug().Str("note", `"module":"http"`).Msg("sneaky debug")
+
+	logged := out.String()
+	assert.NotContains(t, logged, "default debug")
+	assert.Contains(t, logged, "default info")
+	assert.NotContains(t, logged, "esbuild info")
+	assert.Contains(t, logged, "esbuild warn")
+	assert.Contains(t, logged, "http debug")
+	assert.NotContains(t, logged, "sneaky debug")
+}
@@ -3,8 +3,11 @@ package logging
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"hsf/src/config"
 	"hsf/src/ee"
+	"io"
+	stdlog "log"
 	"os"
 	"runtime"
 	"sort"
@@ -60,16 +63,86 @@ func init() {
 	}
 }
 
+// Set if config.Config.LogFile is configured. The file always gets JSON.
+var logFile *RotatingFile
+var logFileWriter *AsyncWriter
+
+var logSampler *sampler
+
+// Logs to the same places as the global logger, but without sampling.
+var unsampledLogger zerolog.Logger
+
+// The most recent log entries, for the admin server. Nil if disabled with
+// config.Config.LogRecentEntries.
+var Recent *RingBuffer
+
 func init() {
 	zerolog.ErrorStackMarshaler = ee.ZerologStackMarshaler
-	log.Logger = log.Output(NewPrettyZerologWriter()).With().Stack().Logger()
-	zerolog.SetGlobalLevel(config.Config.LogLevel)
+	if config.Config.LogStackTrimPrefixes != nil {
+		ee.TrimPrefixes = config.Config.LogStackTrimPrefixes
+	}
+
+	var out io.Writer
+	switch config.Config.LogFormat.OrDefault(config.Config.Env) {
+	case config.LogFormatJSON:
+		out = os.Stderr
+	default:
+		out = NewPrettyZerologWriter()
+	}
+
+	if fileCfg := config.Config.LogFile.WithDefaults(); fileCfg.Path != "" {
+		file, err := NewRotatingFile(fileCfg.Path, RotatingFileOptions{
+			MaxSize:     fileCfg.MaxSize,
+			RotateEvery: fileCfg.RotateEvery,
+			MaxBackups:  fileCfg.MaxBackups,
+			MaxAge:      fileCfg.MaxAge,
+			Compress:    fileCfg.Compress,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Logging to stderr only: %v\n", err)
+		} else {
+			logFile = file
+			logFileWriter = NewAsyncWriter(file, fileCfg.BufferSize)
+			out = zerolog.MultiLevelWriter(out, logFileWriter)
+		}
+	}
+
+	recentSize := config.Config.LogRecentEntries
+	if recentSize == 0 {
+		recentSize = 1000
+	}
+	if recentSize > 0 {
+		Recent = NewRingBuffer(recentSize)
+		out = zerolog.MultiLevelWriter(out, Recent)
+	}
+
+	samplingCfg := config.Config.LogSampling.WithDefaults()
+	logSampler = newSampler(out, SamplingOptions{
+		Window:        samplingCfg.Window,
+		Burst:         samplingCfg.Burst,
+		LevelBursts:   samplingCfg.LevelBursts,
+		MessageBursts: samplingCfg.MessageBursts,
+	})
+	go logSampler.run(make(chan struct{}))
+
+	filter := newModuleLevelFilter(logSampler, config.Config.LogLevel, config.Config.LogModuleLevels)
+	log.Logger = zerolog.New(filter).With().Stack().Logger()
+	zerolog.SetGlobalLevel(filter.MinLevel())
+
+	unsampledFilter := newModuleLevelFilter(out, config.Config.LogLevel, config.Config.LogModuleLevels)
+	unsampledLogger = zerolog.New(unsampledFilter).With().Stack().Logger()
 }
 
 func GlobalLogger() *zerolog.Logger {
 	return &log.Logger
 }
 
+// A logger that bypasses log sampling, for entries that must all be kept no
+// matter how many there are, such as the access log.
+func Unsampled() *zerolog.Logger {
+	return &unsampledLogger
+}
+
 func Trace() *zerolog.Event {
 	return log.Trace().Timestamp().Stack()
 }
@@ -105,6 +178,7 @@ func With() zerolog.Context {
 type PrettyZerologWriter struct {
 	wd                  string
 	wasLastLogMultiline bool
+	colors              bool
 }
 
 type PrettyLogEntry struct {
@@ -137,9 +211,23 @@ func NewPrettyZerologWriter() *PrettyZerologWriter {
 	return &PrettyZerologWriter{
 		wd:                  wd,
 		wasLastLogMultiline: false,
+		colors:              stderrIsTerminal() && os.Getenv("NO_COLOR") == "",
 	}
 }
 
+// Returns the given ANSI escape code, or nothing if colors are disabled.
+func (w *PrettyZerologWriter) c(code string) string {
+	if !w.colors {
+		return ""
+	}
+	return code
+}
+
+func stderrIsTerminal() bool {
+	info, err := os.Stderr.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
 func (w *PrettyZerologWriter) Write(p []byte) (int, error) {
 	var fields map[string]interface{}
 	err := json.Unmarshal(p, &fields)
@@ -164,7 +252,7 @@ func (w *PrettyZerologWriter) Write(p []byte) (int, error) {
 		case zerolog.ErrorFieldName:
 			pretty.Error = val.(string)
 		case zerolog.ErrorStackFieldName:
-			pretty.StackTrace = val.([]interface{})
+			pretty.StackTrace, _ = val.([]interface{})
 		default:
 			pretty.OtherFields = append(pretty.OtherFields, PrettyField{
 				Name:  name,
@@ -186,21 +274,21 @@ func (w *PrettyZerologWriter) Write(p []byte) (int, error) {
 	b.WriteString(pretty.Timestamp)
 	b.WriteString(" ")
 	if pretty.Level != "" {
-		b.WriteString(ColorFromLevel[pretty.Level])
-		b.WriteString(Bold)
+		b.WriteString(w.c(ColorFromLevel[pretty.Level]))
+		b.WriteString(w.c(Bold))
 		b.WriteString(strings.ToUpper(pretty.Level))
-		b.WriteString(Reset)
+		b.WriteString(w.c(Reset))
 		b.WriteString(": ")
 	}
 	b.WriteString(pretty.Message)
 	b.WriteString("\n")
 	if pretty.Error != "" {
-		b.WriteString("  " + Bold + Red + "ERROR:" + Reset + " ")
-		b.WriteString(pretty.Error)
+		b.WriteString("  " + w.c(Bold+Red) + "ERROR:" + w.c(Reset) + " ")
+		b.WriteString(strings.ReplaceAll(pretty.Error, "\n", "\n    "))
 		b.WriteString("\n")
 	}
 	if len(pretty.OtherFields) > 0 {
-		b.WriteString("  " + Bold + Blue + "Fields:" + Reset + "\n")
+		b.WriteString("  " + w.c(Bold+Blue) + "Fields:" + w.c(Reset) + "\n")
 		for _, field := range pretty.OtherFields {
 			valuePretty, _ := json.MarshalIndent(field.Value, "    ", "  ")
 			b.WriteString("    ")
@@ -211,25 +299,78 @@ func (w *PrettyZerologWriter) Write(p []byte) (int, error) {
 		}
 	}
 	if pretty.StackTrace != nil {
-		b.WriteString("  " + Bold + Blue + "Stack trace:" + Reset + "\n")
-		for _, frame := range pretty.StackTrace {
-			frameMap := frame.(map[string]interface{})
-			file := frameMap["file"].(string)
-			file = strings.Replace(file, w.wd, ".", 1)
-
-			b.WriteString("    ")
-			b.WriteString(frameMap["function"].(string))
-			b.WriteString(" (")
-			b.WriteString(file)
-			b.WriteString(":")
-			b.WriteString(strconv.Itoa(int(frameMap["line"].(float64))))
-			b.WriteString(")\n")
+		if isMultiStack(pretty.StackTrace) {
+			b.WriteString("  " + w.c(Bold+Blue) + "Errors:" + w.c(Reset) + "\n")
+			for i, sub := range pretty.StackTrace {
+				subMap, _ := sub.(map[string]interface{})
+				subError, _ := subMap["error"].(string)
+				b.WriteString(fmt.Sprintf("    %s[%d]%s ", w.c(Bold), i+1, w.c(Reset)))
+				b.WriteString(strings.ReplaceAll(subError, "\n", "\n        "))
+				b.WriteString("\n")
+				subStack, _ := subMap["stack"].([]interface{})
+				w.writeStack(&b, subStack, "        ")
+			}
+		} else {
+			b.WriteString("  " + w.c(Bold+Blue) + "Stack trace:" + w.c(Reset) + "\n")
+			w.writeStack(&b, pretty.StackTrace, "    ")
 		}
 	}
 
 	w.wasLastLogMultiline = isMultiline
 
-	return os.Stderr.Write([]byte(b.String()))
+	// Report the length of what we were given, not what we wrote, or
+	// zerolog's multi-writers treat it as a short write.
+	if _, err := os.Stderr.Write([]byte(b.String())); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *PrettyZerologWriter) writeStack(b *strings.Builder, frames []interface{}, indent string) {
+	for _, frame := range frames {
+		frameMap, _ := frame.(map[string]interface{})
+		function, _ := frameMap["function"].(string)
+		file, _ := frameMap["file"].(string)
+		line, _ := frameMap["line"].(float64)
+		file = strings.Replace(file, w.wd, ".", 1)
+
+		b.WriteString(indent)
+		b.WriteString(function)
+		b.WriteString(" (")
+		b.WriteString(file)
+		b.WriteString(":")
+		b.WriteString(strconv.Itoa(int(line)))
+		b.WriteString(")\n")
+	}
+}
+
+// Reports whether a logged stack is an ee.MultiStack (a list of errors with
+// their stacks) rather than a list of frames.
+func isMultiStack(stack []interface{}) bool {
+	if len(stack) == 0 {
+		return false
+	}
+	first, _ := stack[0].(map[string]interface{})
+	_, hasError := first["error"]
+	return hasError
+}
+
+// Makes sure everything logged so far has been written out. Call this before
+// the process exits.
+func Flush() {
+	logSampler.flush()
+	if logFileWriter != nil {
+		logFileWriter.Flush(5 * time.Second)
+	}
+	os.Stderr.Sync()
+}
+
+// Reopens the log file, if there is one, e.g. after logrotate has moved it.
+func ReopenFiles() error {
+	if logFile == nil {
+		return nil
+	}
+	return logFile.Reopen()
 }
 
 func LogPanics(logger *zerolog.Logger) {
@@ -253,6 +394,23 @@ func LogPanicValue(logger *zerolog.Logger, val interface{}, msg string) {
 	}
 }
 
+// Returns a standard library *log.Logger that sends each line it is given to
+// logger at the given level. Useful for libraries that only accept a
+// *log.Logger, such as http.Server's ErrorLog.
+func NewStdLogger(logger *zerolog.Logger, level zerolog.Level) *stdlog.Logger {
+	return stdlog.New(&stdLogWriter{logger: logger, level: level}, "", 0)
+}
+
+type stdLogWriter struct {
+	logger *zerolog.Logger
+	level  zerolog.Level
+}
+
+func (w *stdLogWriter) Write(p []byte) (int, error) {
+	w.logger.WithLevel(w.level).Timestamp().Msg(strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
 const LoggerContextKey = "logger"
 
 func AttachLoggerToContext(logger *zerolog.Logger, ctx context.Context) context.Context {
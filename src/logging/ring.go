@@ -0,0 +1,167 @@
+package logging
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+/*
+ * Keeps the most recent log entries in memory, so that you can see what just
+ * happened from the admin server without going digging through log files.
+ * Entries are decoded from zerolog's JSON, so they include everything that
+ * was logged, including stack traces from ee errors.
+ *
+ * Subscribers get new entries as they are logged, which the admin server
+ * uses for a live tail.
+ */
+
+type RecentEntry struct {
+	Seq       uint64         `json:"seq"` // Increases by one for each entry
+	Time      time.Time      `json:"time"`
+	Level     string         `json:"level"`
+	Message   string         `json:"message"`
+	Module    string         `json:"module,omitempty"`
+	RequestID string         `json:"request_id,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	Stack     []any          `json:"stack,omitempty"`
+	Fields    map[string]any `json:"fields,omitempty"`
+}
+
+type RecentFilter struct {
+	MinLevel  zerolog.Level // zerolog.TraceLevel for everything
+	Module    string        // Empty matches any module
+	RequestID string        // Empty matches any request
+}
+
+func (f RecentFilter) Matches(e RecentEntry) bool {
+	if level, err := zerolog.ParseLevel(e.Level); err == nil && level < f.MinLevel {
+		return false
+	}
+	if f.Module != "" && e.Module != f.Module {
+		return false
+	}
+	if f.RequestID != "" && e.RequestID != f.RequestID {
+		return false
+	}
+	return true
+}
+
+type RingBuffer struct {
+	mu          sync.Mutex
+	entries     []RecentEntry // Used as a circular buffer once full
+	next        int           // Where the next entry goes once full
+	seq         uint64
+	subscribers map[chan RecentEntry]struct{}
+}
+
+var _ zerolog.LevelWriter = &RingBuffer{}
+
+func NewRingBuffer(size int) *RingBuffer {
+	return &RingBuffer{
+		entries:     make([]RecentEntry, 0, size),
+		subscribers: make(map[chan RecentEntry]struct{}),
+	}
+}
+
+func (r *RingBuffer) Write(p []byte) (int, error) {
+	var fields map[string]any
+	if err := json.Unmarshal(p, &fields); err != nil {
+		return len(p), nil // Not JSON; not from zerolog
+	}
+
+	var e RecentEntry
+	for name, val := range fields {
+		str, _ := val.(string)
+		switch name {
+		case zerolog.TimestampFieldName:
+			e.Time, _ = time.Parse(time.RFC3339, str)
+		case zerolog.LevelFieldName:
+			e.Level = str
+		case zerolog.MessageFieldName:
+			e.Message = str
+		case zerolog.ErrorFieldName:
+			e.Error = str
+		case zerolog.ErrorStackFieldName:
+			e.Stack, _ = val.([]any)
+		case ModuleFieldName:
+			e.Module = str
+		case "RequestID":
+			e.RequestID = str
+		default:
+			if e.Fields == nil {
+				e.Fields = make(map[string]any)
+			}
+			e.Fields[name] = val
+		}
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	r.add(e)
+	return len(p), nil
+}
+
+func (r *RingBuffer) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	return r.Write(p)
+}
+
+func (r *RingBuffer) add(e RecentEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.seq++
+	e.Seq = r.seq
+	if len(r.entries) < cap(r.entries) {
+		r.entries = append(r.entries, e)
+	} else if cap(r.entries) > 0 {
+		r.entries[r.next] = e
+		r.next = (r.next + 1) % cap(r.entries)
+	}
+
+	for sub := range r.subscribers {
+		select {
+		case sub <- e:
+		default:
+			// The subscriber is falling behind; it will notice the gap in Seq.
+		}
+	}
+}
+
+// Returns the buffered entries that match the filter, oldest first.
+func (r *RingBuffer) Entries(filter RecentFilter) []RecentEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var result []RecentEntry
+	for i := range r.entries {
+		e := r.entries[(r.next+i)%len(r.entries)]
+		if filter.Matches(e) {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// Returns a channel that receives new entries as they are logged. Call the
+// returned function to unsubscribe. Entries are dropped if the channel's
+// buffer is full.
+func (r *RingBuffer) Subscribe() (<-chan RecentEntry, func()) {
+	ch := make(chan RecentEntry, 100)
+
+	r.mu.Lock()
+	r.subscribers[ch] = struct{}{}
+	r.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			r.mu.Lock()
+			delete(r.subscribers, ch)
+			r.mu.Unlock()
+		})
+	}
+}
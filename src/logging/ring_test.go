@@ -0,0 +1,41 @@
+package logging
+
+import (
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRingBuffer(t *testing.T) {
+	ring := NewRingBuffer(3)
+	logger := zerolog.New(ring)
+
+	updates, unsubscribe := ring.Subscribe()
+	defer unsubscribe()
+
+	logger.Debug().Msg("one")
+	logger.Info().Str("module", "EsBuild").Msg("two")
+	logger.Warn().Str("RequestID", "abc").Int("Count", 3).Msg("three")
+	logger.Error().Str("RequestID", "abc").Msg("four")
+
+	all := ring.Entries(RecentFilter{MinLevel: zerolog.TraceLevel})
+	var messages []string
+	for _, e := range all {
+		messages = append(messages, e.Message)
+	}
+	assert.Equal(t, []string{"two", "three", "four"}, messages, "oldest entry should be dropped")
+	assert.Equal(t, uint64(4), all[2].Seq)
+	assert.Equal(t, "EsBuild", all[0].Module)
+	assert.Equal(t, float64(3), all[1].Fields["Count"])
+
+	byRequest := ring.Entries(RecentFilter{MinLevel: zerolog.TraceLevel, RequestID: "abc"})
+	assert.Len(t, byRequest, 2)
+	byLevel := ring.Entries(RecentFilter{MinLevel: zerolog.ErrorLevel})
+	assert.Len(t, byLevel, 1)
+	byModule := ring.Entries(RecentFilter{MinLevel: zerolog.TraceLevel, Module: "EsBuild"})
+	assert.Len(t, byModule, 1)
+
+	assert.Len(t, updates, 4)
+	assert.Equal(t, "one", (<-updates).Message)
+}
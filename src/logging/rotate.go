@@ -0,0 +1,244 @@
+package logging
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"hsf/src/ee"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * A log file that rotates itself. When the file gets too big, or when the
+ * rotation interval passes, it is renamed with a timestamp, e.g.
+ *
+ *   logs/hsf.log -> logs/hsf-2024-03-05T14-07-09.000.log
+ *
+ * and a fresh file is started. Rotated files can be gzipped, and old ones are
+ * deleted according to MaxBackups and MaxAge. Compression and cleanup happen
+ * in the background so that they don't hold up logging.
+ *
+ * If you would rather use logrotate, leave the size and interval unset and
+ * call Reopen (on SIGHUP, in the website) after logrotate moves the file.
+ */
+
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+type RotatingFileOptions struct {
+	MaxSize     int64         // Rotate when the file would exceed this many bytes; 0 for no limit
+	RotateEvery time.Duration // Rotate on multiples of this interval (in UTC); 0 to disable
+	MaxBackups  int           // Rotated files to keep; 0 keeps all
+	MaxAge      time.Duration // Delete rotated files older than this; 0 keeps all
+	Compress    bool          // Gzip rotated files
+}
+
+type RotatingFile struct {
+	path string
+	opts RotatingFileOptions
+
+	mu         sync.Mutex
+	file       *os.File
+	size       int64
+	nextRotate time.Time
+
+	cleanupMu sync.Mutex // Only one cleanup at a time
+}
+
+var _ io.WriteCloser = &RotatingFile{}
+
+func NewRotatingFile(path string, opts RotatingFileOptions) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, opts: opts}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, ee.New(err, "failed to create log directory for %s", path)
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return ee.New(err, "failed to open log file %s", f.path)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return ee.New(err, "failed to stat log file %s", f.path)
+	}
+
+	f.file = file
+	f.size = info.Size()
+	if f.opts.RotateEvery > 0 {
+		f.nextRotate = time.Now().UTC().Truncate(f.opts.RotateEvery).Add(f.opts.RotateEvery)
+	}
+	return nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	tooBig := f.opts.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.opts.MaxSize
+	tooOld := !f.nextRotate.IsZero() && !time.Now().Before(f.nextRotate)
+	if tooBig || tooOld {
+		if err := f.rotate(); err != nil {
+			// Keep writing to the old file rather than losing logs
+			fmt.Fprintf(os.Stderr, "failed to rotate log file: %v\n", err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Must be called with f.mu held.
+func (f *RotatingFile) rotate() error {
+	ext := filepath.Ext(f.path)
+	backup := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(f.path, ext), time.Now().UTC().Format(backupTimeFormat), ext)
+	if err := os.Rename(f.path, backup); err != nil {
+		return ee.New(err, "failed to rename %s", f.path)
+	}
+
+	old := f.file
+	if err := f.open(); err != nil {
+		f.file = old
+		return err
+	}
+	old.Close()
+
+	go f.cleanup(backup)
+	return nil
+}
+
+// Closes and reopens the file at the same path. Use this after something
+// else has moved the file, e.g. logrotate.
+func (f *RotatingFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	old := f.file
+	if err := f.open(); err != nil {
+		return err
+	}
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// Compresses the newly rotated file, if requested, and deletes old backups.
+func (f *RotatingFile) cleanup(newBackup string) {
+	f.cleanupMu.Lock()
+	defer f.cleanupMu.Unlock()
+
+	if f.opts.Compress {
+		if err := gzipFile(newBackup); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to compress rotated log file: %v\n", err)
+		}
+	}
+
+	backups, err := f.backups()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to list rotated log files: %v\n", err)
+		return
+	}
+	for i, b := range backups {
+		tooMany := f.opts.MaxBackups > 0 && i >= f.opts.MaxBackups
+		tooOld := f.opts.MaxAge > 0 && time.Since(b.time) > f.opts.MaxAge
+		if tooMany || tooOld {
+			if err := os.Remove(b.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				fmt.Fprintf(os.Stderr, "failed to delete old log file: %v\n", err)
+			}
+		}
+	}
+}
+
+type logBackup struct {
+	path string
+	time time.Time
+}
+
+// Lists rotated files, newest first.
+func (f *RotatingFile) backups() ([]logBackup, error) {
+	dir := filepath.Dir(f.path)
+	ext := filepath.Ext(f.path)
+	prefix := strings.TrimSuffix(filepath.Base(f.path), ext) + "-"
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []logBackup
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		stamp := strings.TrimPrefix(name, prefix)
+		stamp = strings.TrimSuffix(stamp, ".gz")
+		stamp = strings.TrimSuffix(stamp, ext)
+		t, err := time.Parse(backupTimeFormat, stamp)
+		if err != nil {
+			continue // Not one of ours
+		}
+		backups = append(backups, logBackup{path: filepath.Join(dir, name), time: t})
+	}
+
+	slices.SortFunc(backups, func(a, b logBackup) int {
+		return b.time.Compare(a.time)
+	})
+	return backups, nil
+}
+
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,94 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.log")
+
+	f, err := NewRotatingFile(path, RotatingFileOptions{
+		MaxSize:    10,
+		MaxBackups: 2,
+		Compress:   true,
+	})
+	assert.Nil(t, err)
+	defer f.Close()
+
+	for _, line := range []string{"aaaaaaa\n", "bbbbbbb\n", "ccccccc\n", "ddddddd\n"} {
+		_, err := f.Write([]byte(line))
+		assert.Nil(t, err)
+		time.Sleep(5 * time.Millisecond) // Give each backup its own timestamp
+	}
+
+	current, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "ddddddd\n", string(current))
+
+	// Compression and cleanup happen in the background
+	assert.Eventually(t, func() bool {
+		backups, err := f.backups()
+		if err != nil || len(backups) != 2 {
+			return false
+		}
+		for _, b := range backups {
+			if !strings.HasSuffix(b.path, ".log.gz") {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRotatingFileReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.log")
+
+	f, err := NewRotatingFile(path, RotatingFileOptions{})
+	assert.Nil(t, err)
+	defer f.Close()
+
+	f.Write([]byte("before\n"))
+	assert.Nil(t, os.Rename(path, path+".1")) // What logrotate does
+	f.Write([]byte("still old\n"))
+	assert.Nil(t, f.Reopen())
+	f.Write([]byte("after\n"))
+
+	old, _ := os.ReadFile(path + ".1")
+	assert.Equal(t, "before\nstill old\n", string(old))
+	current, _ := os.ReadFile(path)
+	assert.Equal(t, "after\n", string(current))
+}
+
+type slowWriter struct {
+	strings.Builder
+	release chan struct{}
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return w.Builder.Write(p)
+}
+
+func TestAsyncWriterDropsWhenFull(t *testing.T) {
+	out := &slowWriter{release: make(chan struct{})}
+	w := NewAsyncWriter(out, 2)
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		w.Write([]byte("line\n"))
+	}
+	assert.Less(t, time.Since(start), 100*time.Millisecond, "writes should not block")
+	assert.Greater(t, w.Dropped(), int64(0))
+
+	close(out.release)
+	assert.Nil(t, w.Close())
+	assert.Contains(t, out.String(), "Dropped log messages")
+}
@@ -0,0 +1,207 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+/*
+ * When something goes wrong in a loop, or a misbehaving client hammers us,
+ * the same message can be logged thousands of times, burying everything
+ * else. To prevent this, messages are counted per level and message text in
+ * short windows. Once a message has been logged Burst times in a window, the
+ * rest of its repeats in that window are suppressed, and at the end of the
+ * window a single warning says how many were dropped.
+ *
+ * Only the message text is compared, not the fields, so log variable data
+ * in fields (rather than with Msgf) if you want repeats to be grouped. By
+ * default only debug and info messages are sampled. Logs that must be
+ * complete, like the access log, can skip sampling entirely with Unsampled.
+ *
+ * See config.LogSamplingConfig for the settings.
+ */
+
+type SamplingOptions struct {
+	Window        time.Duration
+	Burst         int                   // Default per message and window; negative for no limit
+	LevelBursts   map[zerolog.Level]int // Overrides Burst by level
+	MessageBursts map[string]int        // Overrides Burst by exact message
+}
+
+// Tracking stops for new messages past this many in one window, so that a
+// flood of unique messages can't use unbounded memory.
+const maxSampledKeys = 10000
+
+type sampleKey struct {
+	level   zerolog.Level
+	message string
+}
+
+type sampleCount struct {
+	logged     int
+	suppressed int
+}
+
+type sampler struct {
+	out  zerolog.LevelWriter
+	opts SamplingOptions
+
+	mu          sync.Mutex
+	counts      map[sampleKey]*sampleCount
+	windowStart time.Time
+}
+
+var _ zerolog.LevelWriter = &sampler{}
+
+func newSampler(out io.Writer, opts SamplingOptions) *sampler {
+	lw, ok := out.(zerolog.LevelWriter)
+	if !ok {
+		lw = zerolog.LevelWriterAdapter{Writer: out}
+	}
+	return &sampler{
+		out:         lw,
+		opts:        opts,
+		counts:      make(map[sampleKey]*sampleCount),
+		windowStart: time.Now(),
+	}
+}
+
+// Writes a summary of the current window every Window until stop is closed.
+func (s *sampler) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(s.opts.Window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (s *sampler) Write(p []byte) (int, error) {
+	return s.WriteLevel(zerolog.NoLevel, p)
+}
+
+func (s *sampler) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	if level >= zerolog.FatalLevel {
+		// The process is about to die; we want to see why.
+		return s.out.WriteLevel(level, p)
+	}
+
+	message := messageOf(p)
+	burst := s.burstFor(level, message)
+	if burst < 0 {
+		return s.out.WriteLevel(level, p)
+	}
+
+	s.mu.Lock()
+	key := sampleKey{level: level, message: message}
+	count, ok := s.counts[key]
+	if !ok {
+		if len(s.counts) >= maxSampledKeys {
+			s.mu.Unlock()
+			return s.out.WriteLevel(level, p)
+		}
+		count = &sampleCount{}
+		s.counts[key] = count
+	}
+	allowed := count.logged < burst
+	if allowed {
+		count.logged++
+	} else {
+		count.suppressed++
+	}
+	s.mu.Unlock()
+
+	if !allowed {
+		return len(p), nil
+	}
+	return s.out.WriteLevel(level, p)
+}
+
+func (s *sampler) burstFor(level zerolog.Level, message string) int {
+	if burst, ok := s.opts.MessageBursts[message]; ok {
+		return burst
+	}
+	if burst, ok := s.opts.LevelBursts[level]; ok {
+		return burst
+	}
+	return s.opts.Burst
+}
+
+// Ends the current window, writing a warning for each message that was
+// suppressed.
+func (s *sampler) flush() {
+	s.mu.Lock()
+	counts := s.counts
+	windowStart := s.windowStart
+	s.counts = make(map[sampleKey]*sampleCount)
+	s.windowStart = time.Now()
+	s.mu.Unlock()
+
+	var suppressed []sampleKey
+	for key, count := range counts {
+		if count.suppressed > 0 {
+			suppressed = append(suppressed, key)
+		}
+	}
+	sort.Slice(suppressed, func(i, j int) bool {
+		return counts[suppressed[i]].suppressed > counts[suppressed[j]].suppressed
+	})
+
+	for _, key := range suppressed {
+		count := counts[key]
+		s.out.WriteLevel(zerolog.WarnLevel, suppressionSummary(key, count, time.Since(windowStart)))
+	}
+}
+
+func suppressionSummary(key sampleKey, count *sampleCount, window time.Duration) []byte {
+	var b bytes.Buffer
+	originalMessage, _ := json.Marshal(key.message)
+	fmt.Fprintf(&b,
+		`{"%s":"warn","%s":%q,"Suppressed":%d,"Logged":%d,"OriginalLevel":%q,"OriginalMessage":%s,"Window":%q,"%s":%q}`+"\n",
+		zerolog.LevelFieldName,
+		zerolog.TimestampFieldName, time.Now().Format(time.RFC3339),
+		count.suppressed, count.logged,
+		key.level.String(), originalMessage,
+		window.Round(time.Second).String(),
+		zerolog.MessageFieldName, fmt.Sprintf("Suppressed %d similar messages", count.suppressed),
+	)
+	return b.Bytes()
+}
+
+var messageFieldPrefix = []byte(`"` + zerolog.MessageFieldName + `":"`)
+
+// Finds the message in an encoded event without decoding the whole thing.
+// zerolog always writes the message last, so we search from the end.
+func messageOf(event []byte) string {
+	i := bytes.LastIndex(event, messageFieldPrefix)
+	if i < 0 {
+		return ""
+	}
+	rest := event[i+len(messageFieldPrefix)-1:] // Keep the opening quote
+	for j := 1; j < len(rest); j++ {
+		switch rest[j] {
+		case '\\':
+			j++ // Skip the escaped character
+		case '"':
+			raw := rest[:j+1]
+			if bytes.IndexByte(raw, '\\') < 0 {
+				return string(raw[1:j])
+			}
+			var message string
+			json.Unmarshal(raw, &message)
+			return message
+		}
+	}
+	return ""
+}
@@ -0,0 +1,111 @@
+package logging
+
+import (
+	"encoding/json"
+	"hsf/src/config"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSampler(t *testing.T) {
+	var out strings.Builder
+	s := newSampler(&out, SamplingOptions{
+		Window:        time.Minute,
+		Burst:         3,
+		LevelBursts:   map[zerolog.Level]int{zerolog.ErrorLevel: 1},
+		MessageBursts: map[string]int{"always": -1},
+	})
+	logger := zerolog.New(s)
+
+	for i := 0; i < 10; i++ {
+		logger.Info().Int("i", i).Msg("again")
+		logger.Error().Msg("broken")
+		logger.Info().Msg("always")
+	}
+	logger.Warn().Msg("again") // Counted separately from info
+
+	logged := out.String()
+	assert.Equal(t, 3+1, strings.Count(logged, `"message":"again"`))
+	assert.Equal(t, 1, strings.Count(logged, `"message":"broken"`))
+	assert.Equal(t, 10, strings.Count(logged, `"message":"always"`))
+
+	out.Reset()
+	s.flush()
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+
+	var first map[string]any
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &first))
+	assert.Equal(t, "warn", first["level"])
+	assert.Equal(t, "broken", first["OriginalMessage"])
+	assert.Equal(t, "error", first["OriginalLevel"])
+	assert.EqualValues(t, 9, first["Suppressed"])
+	assert.EqualValues(t, 1, first["Logged"])
+	assert.Equal(t, "Suppressed 9 similar messages", first["message"])
+	assert.Contains(t, lines[1], `"OriginalMessage":"again"`)
+
+	// A new window starts from scratch
+	out.Reset()
+	logger.Error().Msg("broken")
+	assert.Contains(t, out.String(), "broken")
+	out.Reset()
+	s.flush()
+	assert.Empty(t, out.String())
+}
+
+func TestSamplingDefaults(t *testing.T) {
+	var out strings.Builder
+	cfg := config.LogSamplingConfig{}.WithDefaults()
+	s := newSampler(&out, SamplingOptions{
+		Window:        cfg.Window,
+		Burst:         cfg.Burst,
+		LevelBursts:   cfg.LevelBursts,
+		MessageBursts: cfg.MessageBursts,
+	})
+	logger := zerolog.New(s)
+
+	for i := 0; i < 50; i++ {
+		logger.Info().Msg("chatty")
+		logger.Warn().Msg("careful")
+		logger.Error().Msg("Internal server error")
+	}
+	logged := out.String()
+	assert.Equal(t, 20, strings.Count(logged, `"message":"chatty"`))
+	assert.Equal(t, 50, strings.Count(logged, `"message":"careful"`))
+	assert.Equal(t, 50, strings.Count(logged, `"message":"Internal server error"`))
+
+	// Explicit level settings still win.
+	cfg = config.LogSamplingConfig{LevelBursts: map[zerolog.Level]int{zerolog.WarnLevel: 5}}.WithDefaults()
+	assert.Equal(t, 5, cfg.LevelBursts[zerolog.WarnLevel])
+	assert.Equal(t, -1, cfg.LevelBursts[zerolog.ErrorLevel])
+}
+
+func TestUnsampled(t *testing.T) {
+	require.NotNil(t, Recent)
+	before := len(Recent.Entries(RecentFilter{MinLevel: zerolog.InfoLevel}))
+	for i := 0; i < 50; i++ {
+		Unsampled().Info().Msg("Served request")
+	}
+	served := 0
+	for _, e := range Recent.Entries(RecentFilter{MinLevel: zerolog.InfoLevel})[before:] {
+		if e.Message == "Served request" {
+			served++
+		}
+	}
+	assert.Equal(t, 50, served)
+}
+
+func TestMessageOf(t *testing.T) {
+	var out strings.Builder
+	logger := zerolog.New(&out)
+	logger.Info().Str("message2", "nope").Interface("Data", map[string]string{"message": "nested"}).Msg(`say "hi"\n`)
+	assert.Equal(t, `say "hi"\n`, messageOf([]byte(out.String())))
+
+	assert.Equal(t, "", messageOf([]byte(`{"level":"info"}`)))
+	assert.Equal(t, "plain", messageOf([]byte(`{"message":"plain"}`)))
+}
@@ -0,0 +1,217 @@
+package logging
+
+import (
+	"context"
+	stdlog "log"
+	"log/slog"
+	"slices"
+
+	"github.com/rs/zerolog"
+)
+
+/*
+ * Libraries (and parts of the standard library) that log through log/slog
+ * or the old log package would otherwise bypass everything set up in this
+ * package. init installs a SlogHandler as the slog default and points the
+ * log package at the global logger, so their output ends up in the same
+ * stream, with the same format, levels, sampling and sinks as ours.
+ *
+ * slog attrs become zerolog fields, and groups become nested objects. An
+ * attr named "module" at the top level works with config.LogModuleLevels
+ * like any other module field.
+ */
+
+// An slog.Handler that writes to a zerolog logger.
+type SlogHandler struct {
+	logger *zerolog.Logger
+
+	// groups[i] is the name of the i-th open group. attrs[0] holds the attrs
+	// added before any group was opened, and attrs[i+1] the ones added
+	// inside groups[i].
+	groups []string
+	attrs  [][]slog.Attr
+}
+
+var _ slog.Handler = &SlogHandler{}
+
+// Creates a handler that writes to logger, or to the logger attached to the
+// context passed to Handle if there is one (see AttachLoggerToContext).
+func NewSlogHandler(logger *zerolog.Logger) *SlogHandler {
+	return &SlogHandler{
+		logger: logger,
+		attrs:  make([][]slog.Attr, 1),
+	}
+}
+
+func init() {
+	slog.SetDefault(slog.New(NewSlogHandler(GlobalLogger())))
+
+	// slog.SetDefault sends the log package to slog, at info level. Send it
+	// straight to zerolog instead, so that lines aren't formatted twice.
+	stdlog.SetOutput(&stdLogWriter{logger: GlobalLogger(), level: zerolog.InfoLevel})
+	stdlog.SetFlags(0)
+	stdlog.SetPrefix("")
+}
+
+// Converts an slog level to the closest zerolog level at or below it.
+func ZerologLevel(level slog.Level) zerolog.Level {
+	switch {
+	case level < slog.LevelDebug:
+		return zerolog.TraceLevel
+	case level < slog.LevelInfo:
+		return zerolog.DebugLevel
+	case level < slog.LevelWarn:
+		return zerolog.InfoLevel
+	case level < slog.LevelError:
+		return zerolog.WarnLevel
+	default:
+		return zerolog.ErrorLevel
+	}
+}
+
+func (h *SlogHandler) loggerFor(ctx context.Context) *zerolog.Logger {
+	if ctx != nil {
+		if logger, ok := ctx.Value(LoggerContextKey).(*zerolog.Logger); ok {
+			return logger
+		}
+	}
+	return h.logger
+}
+
+func (h *SlogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	zlevel := ZerologLevel(level)
+	return zlevel >= zerolog.GlobalLevel() && zlevel >= h.loggerFor(ctx).GetLevel()
+}
+
+func (h *SlogHandler) Handle(ctx context.Context, r slog.Record) error {
+	event := h.loggerFor(ctx).WithLevel(ZerologLevel(r.Level))
+	if event == nil {
+		return nil
+	}
+	if !r.Time.IsZero() {
+		event.Time(zerolog.TimestampFieldName, r.Time)
+	}
+
+	// Build the innermost group first, since each group contains the next.
+	var inner *zerolog.Event
+	for i := len(h.groups); i >= 0; i-- {
+		var e *zerolog.Event
+		if i == 0 {
+			e = event
+		} else {
+			e = zerolog.Dict()
+		}
+		empty := true
+		for _, attr := range h.attrs[i] {
+			empty = !addSlogAttr(e, attr, i == 0) && empty
+		}
+		if i == len(h.groups) {
+			r.Attrs(func(attr slog.Attr) bool {
+				empty = !addSlogAttr(e, attr, i == 0) && empty
+				return true
+			})
+		}
+		if inner != nil {
+			e.Dict(h.groups[i], inner)
+			empty = false
+		}
+		// Groups with nothing in them are left out entirely.
+		if empty {
+			inner = nil
+		} else {
+			inner = e
+		}
+	}
+
+	event.Msg(r.Message)
+	return nil
+}
+
+func (h *SlogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+	res := h.clone()
+	last := len(res.attrs) - 1
+	res.attrs[last] = append(slices.Clip(res.attrs[last]), attrs...)
+	return res
+}
+
+func (h *SlogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	res := h.clone()
+	res.groups = append(res.groups, name)
+	res.attrs = append(res.attrs, nil)
+	return res
+}
+
+func (h *SlogHandler) clone() *SlogHandler {
+	return &SlogHandler{
+		logger: h.logger,
+		groups: append([]string(nil), h.groups...),
+		attrs:  append([][]slog.Attr(nil), h.attrs...),
+	}
+}
+
+// Adds an attr to a zerolog event, returning false if there was nothing to
+// add. Errors at the top level under "err" or "error" are added with Err, so
+// that they get a stack trace like any other error we log.
+func addSlogAttr(e *zerolog.Event, attr slog.Attr, topLevel bool) bool {
+	attr.Value = attr.Value.Resolve()
+	if attr.Equal(slog.Attr{}) {
+		return false
+	}
+
+	value := attr.Value
+	switch value.Kind() {
+	case slog.KindGroup:
+		attrs := value.Group()
+		if len(attrs) == 0 {
+			return false
+		}
+		if attr.Key == "" {
+			// Inline the group's attrs, as slog does.
+			added := false
+			for _, a := range attrs {
+				added = addSlogAttr(e, a, topLevel) || added
+			}
+			return added
+		}
+		dict := zerolog.Dict()
+		added := false
+		for _, a := range attrs {
+			added = addSlogAttr(dict, a, false) || added
+		}
+		if !added {
+			return false
+		}
+		e.Dict(attr.Key, dict)
+	case slog.KindString:
+		e.Str(attr.Key, value.String())
+	case slog.KindInt64:
+		e.Int64(attr.Key, value.Int64())
+	case slog.KindUint64:
+		e.Uint64(attr.Key, value.Uint64())
+	case slog.KindFloat64:
+		e.Float64(attr.Key, value.Float64())
+	case slog.KindBool:
+		e.Bool(attr.Key, value.Bool())
+	case slog.KindDuration:
+		e.Dur(attr.Key, value.Duration())
+	case slog.KindTime:
+		e.Time(attr.Key, value.Time())
+	default:
+		if err, ok := value.Any().(error); ok {
+			if topLevel && attr.Key == zerolog.ErrorFieldName || topLevel && attr.Key == "err" {
+				e.Err(err)
+			} else {
+				e.AnErr(attr.Key, err)
+			}
+		} else {
+			e.Interface(attr.Key, value.Any())
+		}
+	}
+	return true
+}
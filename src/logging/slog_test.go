@@ -0,0 +1,77 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	stdlog "log"
+	"log/slog"
+	"strings"
+	"testing"
+	"testing/slogtest"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlogHandlerConformance(t *testing.T) {
+	var out bytes.Buffer
+	logger := zerolog.New(&out)
+	err := slogtest.TestHandler(NewSlogHandler(&logger), func() []map[string]any {
+		var results []map[string]any
+		for _, line := range bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n")) {
+			var m map[string]any
+			require.NoError(t, json.Unmarshal(line, &m))
+			// slogtest expects slog's key for the message.
+			m[slog.MessageKey] = m[zerolog.MessageFieldName]
+			delete(m, zerolog.MessageFieldName)
+			results = append(results, m)
+		}
+		return results
+	})
+	assert.NoError(t, err)
+}
+
+func TestSlogHandler(t *testing.T) {
+	var out strings.Builder
+	logger := zerolog.New(&out)
+	sl := slog.New(NewSlogHandler(&logger))
+
+	sl.With("module", "thing").WithGroup("req").With("id", 7).Warn("hello",
+		"err", errors.New("oops"),
+		slog.Group("user", "name", "ben"),
+	)
+	var m map[string]any
+	require.NoError(t, json.Unmarshal([]byte(out.String()), &m))
+	assert.Equal(t, "warn", m["level"])
+	assert.Equal(t, "hello", m["message"])
+	assert.Equal(t, "thing", m["module"])
+	assert.Equal(t, map[string]any{
+		"id":   float64(7),
+		"err":  "oops",
+		"user": map[string]any{"name": "ben"},
+	}, m["req"])
+
+	out.Reset()
+	sl.Error("top", "error", errors.New("bad"))
+	assert.Contains(t, out.String(), `"error":"bad"`)
+
+	// The default logger goes through the same handler.
+	_, ok := slog.Default().Handler().(*SlogHandler)
+	assert.True(t, ok)
+
+	assert.Equal(t, zerolog.TraceLevel, ZerologLevel(slog.LevelDebug-1))
+	assert.Equal(t, zerolog.InfoLevel, ZerologLevel(slog.LevelInfo+2))
+	assert.Equal(t, zerolog.ErrorLevel, ZerologLevel(slog.LevelError+4))
+}
+
+func TestStdLogBridge(t *testing.T) {
+	var out strings.Builder
+	logger := zerolog.New(&out)
+	NewStdLogger(&logger, zerolog.WarnLevel).Print("from the log package")
+	assert.Contains(t, out.String(), `"level":"warn"`)
+	assert.Contains(t, out.String(), `"message":"from the log package"`)
+
+	assert.Equal(t, 0, stdlog.Flags())
+}
@@ -0,0 +1,465 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+ * A small metrics registry that speaks the Prometheus text exposition format,
+ * without pulling in the Prometheus client library. It supports the three
+ * kinds of metrics we actually use:
+ *
+ * - Counters, which only go up (e.g. requests served).
+ * - Gauges, which go up and down (e.g. requests in flight).
+ * - Histograms, which count observations into buckets (e.g. durations).
+ *
+ * Each comes as a "vec" with labels. A vec with no labels is just a single
+ * metric; call With() with no arguments to get it. For values that already
+ * live somewhere else (e.g. the number of goroutines), use NewGaugeFunc or a
+ * CollectorFunc, which are read at scrape time.
+ *
+ * Metrics are usually declared as package-level variables and registered with
+ * the default registry at the same time:
+ *
+ *   var thingsDone = metrics.Register(metrics.NewCounterVec(
+ *       "hsf_things_done_total", "Things that were done.", "kind",
+ *   ))
+ *
+ *   thingsDone.With("important").Inc()
+ *
+ * Keep label values to a small, fixed set (route patterns, status codes, job
+ * names). Never use user input such as URLs or IPs as label values, or the
+ * number of series will grow without bound.
+ */
+
+type Type string
+
+const (
+	TypeCounter   Type = "counter"
+	TypeGauge     Type = "gauge"
+	TypeHistogram Type = "histogram"
+)
+
+// A set of samples with the same name, e.g. all the series of a CounterVec.
+type Family struct {
+	Name    string
+	Help    string
+	Type    Type
+	Samples []Sample
+}
+
+type Sample struct {
+	Suffix      string // e.g. "_bucket" for histograms
+	LabelNames  []string
+	LabelValues []string
+	Value       float64
+}
+
+// Anything that can report metrics. Collect is called on every scrape.
+type Collector interface {
+	Collect() []Family
+}
+
+// Adapts a function to the Collector interface.
+type CollectorFunc func() []Family
+
+func (f CollectorFunc) Collect() []Family {
+	return f()
+}
+
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+var Default = &Registry{}
+
+func (r *Registry) Register(c Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Registers a collector with the default registry and returns it, so that it
+// can be used in a variable declaration.
+func Register[C Collector](c C) C {
+	Default.Register(c)
+	return c
+}
+
+// Writes all registered metrics in the Prometheus text format.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	r.mu.Lock()
+	collectors := slices.Clone(r.collectors)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		for _, f := range c.Collect() {
+			writeFamily(bw, f)
+		}
+	}
+	return bw.Flush()
+}
+
+func WritePrometheus(w io.Writer) error {
+	return Default.WritePrometheus(w)
+}
+
+// The Content-Type for the output of WritePrometheus.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+func writeFamily(w *bufio.Writer, f Family) {
+	if f.Help != "" {
+		fmt.Fprintf(w, "# HELP %s %s\n", f.Name, escapeHelp(f.Help))
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.Name, f.Type)
+	for _, s := range f.Samples {
+		w.WriteString(f.Name)
+		w.WriteString(s.Suffix)
+		if len(s.LabelNames) > 0 {
+			w.WriteByte('{')
+			for i, name := range s.LabelNames {
+				if i > 0 {
+					w.WriteByte(',')
+				}
+				w.WriteString(name)
+				w.WriteString(`="`)
+				w.WriteString(escapeLabelValue(s.LabelValues[i]))
+				w.WriteByte('"')
+			}
+			w.WriteByte('}')
+		}
+		w.WriteByte(' ')
+		w.WriteString(formatValue(s.Value))
+		w.WriteByte('\n')
+	}
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// A float64 that can be updated atomically.
+type atomicFloat struct {
+	bits atomic.Uint64
+}
+
+func (f *atomicFloat) Add(delta float64) {
+	for {
+		old := f.bits.Load()
+		updated := math.Float64bits(math.Float64frombits(old) + delta)
+		if f.bits.CompareAndSwap(old, updated) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) Set(v float64) {
+	f.bits.Store(math.Float64bits(v))
+}
+
+func (f *atomicFloat) Load() float64 {
+	return math.Float64frombits(f.bits.Load())
+}
+
+// The series of a vec, keyed by their label values. Shared by all the vec
+// types.
+type seriesMap[T any] struct {
+	name       string
+	labelNames []string
+	newSeries  func() *T
+
+	mu     sync.RWMutex
+	series map[string]*seriesEntry[T]
+}
+
+type seriesEntry[T any] struct {
+	labelValues []string
+	metric      *T
+}
+
+func (m *seriesMap[T]) get(labelValues []string) *T {
+	if len(labelValues) != len(m.labelNames) {
+		panic(fmt.Sprintf("metric %s has labels %v but got values %v", m.name, m.labelNames, labelValues))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	m.mu.RLock()
+	entry, ok := m.series[key]
+	m.mu.RUnlock()
+	if ok {
+		return entry.metric
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if entry, ok := m.series[key]; ok {
+		return entry.metric
+	}
+	if m.series == nil {
+		m.series = make(map[string]*seriesEntry[T])
+	}
+	entry = &seriesEntry[T]{
+		labelValues: slices.Clone(labelValues),
+		metric:      m.newSeries(),
+	}
+	m.series[key] = entry
+	return entry.metric
+}
+
+// Calls f for each series, in a stable order.
+func (m *seriesMap[T]) each(f func(labelValues []string, metric *T)) {
+	m.mu.RLock()
+	entries := make([]*seriesEntry[T], 0, len(m.series))
+	for _, entry := range m.series {
+		entries = append(entries, entry)
+	}
+	m.mu.RUnlock()
+
+	slices.SortFunc(entries, func(a, b *seriesEntry[T]) int {
+		return slices.Compare(a.labelValues, b.labelValues)
+	})
+	for _, entry := range entries {
+		f(entry.labelValues, entry.metric)
+	}
+}
+
+type Counter struct {
+	value atomicFloat
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+// Adds to the counter. Counters may only go up, so delta must not be
+// negative.
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		panic("counters cannot decrease")
+	}
+	c.value.Add(delta)
+}
+
+func (c *Counter) Value() float64 {
+	return c.value.Load()
+}
+
+type CounterVec struct {
+	help string
+	m    seriesMap[Counter]
+}
+
+func NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{
+		help: help,
+		m: seriesMap[Counter]{
+			name:       name,
+			labelNames: labelNames,
+			newSeries:  func() *Counter { return &Counter{} },
+		},
+	}
+}
+
+// Returns the counter for the given label values, creating it if necessary.
+func (v *CounterVec) With(labelValues ...string) *Counter {
+	return v.m.get(labelValues)
+}
+
+func (v *CounterVec) Collect() []Family {
+	f := Family{Name: v.m.name, Help: v.help, Type: TypeCounter}
+	v.m.each(func(labelValues []string, c *Counter) {
+		f.Samples = append(f.Samples, Sample{
+			LabelNames:  v.m.labelNames,
+			LabelValues: labelValues,
+			Value:       c.Value(),
+		})
+	})
+	return []Family{f}
+}
+
+type Gauge struct {
+	value atomicFloat
+}
+
+func (g *Gauge) Set(v float64) {
+	g.value.Set(v)
+}
+
+func (g *Gauge) Add(delta float64) {
+	g.value.Add(delta)
+}
+
+func (g *Gauge) Inc() {
+	g.value.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.value.Add(-1)
+}
+
+func (g *Gauge) Value() float64 {
+	return g.value.Load()
+}
+
+type GaugeVec struct {
+	help string
+	m    seriesMap[Gauge]
+}
+
+func NewGaugeVec(name string, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{
+		help: help,
+		m: seriesMap[Gauge]{
+			name:       name,
+			labelNames: labelNames,
+			newSeries:  func() *Gauge { return &Gauge{} },
+		},
+	}
+}
+
+// Returns the gauge for the given label values, creating it if necessary.
+func (v *GaugeVec) With(labelValues ...string) *Gauge {
+	return v.m.get(labelValues)
+}
+
+func (v *GaugeVec) Collect() []Family {
+	f := Family{Name: v.m.name, Help: v.help, Type: TypeGauge}
+	v.m.each(func(labelValues []string, g *Gauge) {
+		f.Samples = append(f.Samples, Sample{
+			LabelNames:  v.m.labelNames,
+			LabelValues: labelValues,
+			Value:       g.Value(),
+		})
+	})
+	return []Family{f}
+}
+
+// A gauge whose value is read from a function at scrape time.
+func NewGaugeFunc(name string, help string, f func() float64) Collector {
+	return CollectorFunc(func() []Family {
+		return []Family{{
+			Name:    name,
+			Help:    help,
+			Type:    TypeGauge,
+			Samples: []Sample{{Value: f()}},
+		}}
+	})
+}
+
+// Default histogram buckets, suitable for request durations in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type Histogram struct {
+	upperBounds []float64
+	counts      []atomic.Uint64 // Not cumulative; one per bucket, plus +Inf
+	sum         atomicFloat
+}
+
+func (h *Histogram) Observe(v float64) {
+	i, _ := slices.BinarySearch(h.upperBounds, v)
+	h.counts[i].Add(1)
+	h.sum.Add(v)
+}
+
+type HistogramVec struct {
+	help    string
+	buckets []float64
+	m       seriesMap[Histogram]
+}
+
+// Creates a histogram with the given bucket upper bounds, which must be
+// sorted. A +Inf bucket is always added.
+func NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if !slices.IsSorted(buckets) {
+		panic(fmt.Sprintf("buckets for histogram %s are not sorted", name))
+	}
+	buckets = slices.Clone(buckets)
+	return &HistogramVec{
+		help:    help,
+		buckets: buckets,
+		m: seriesMap[Histogram]{
+			name:       name,
+			labelNames: labelNames,
+			newSeries: func() *Histogram {
+				return &Histogram{
+					upperBounds: buckets,
+					counts:      make([]atomic.Uint64, len(buckets)+1),
+				}
+			},
+		},
+	}
+}
+
+// Returns the histogram for the given label values, creating it if
+// necessary.
+func (v *HistogramVec) With(labelValues ...string) *Histogram {
+	return v.m.get(labelValues)
+}
+
+func (v *HistogramVec) Collect() []Family {
+	f := Family{Name: v.m.name, Help: v.help, Type: TypeHistogram}
+	bucketLabelNames := append(slices.Clone(v.m.labelNames), "le")
+	v.m.each(func(labelValues []string, h *Histogram) {
+		// There is no separate counter; _count is the cumulative total of the
+		// buckets, so it always matches the +Inf bucket even if observations
+		// land mid-scrape.
+		var cumulative uint64
+		for i := range h.counts {
+			cumulative += h.counts[i].Load()
+			le := math.Inf(1)
+			if i < len(h.upperBounds) {
+				le = h.upperBounds[i]
+			}
+			f.Samples = append(f.Samples, Sample{
+				Suffix:      "_bucket",
+				LabelNames:  bucketLabelNames,
+				LabelValues: append(slices.Clone(labelValues), formatValue(le)),
+				Value:       float64(cumulative),
+			})
+		}
+		f.Samples = append(f.Samples,
+			Sample{
+				Suffix:      "_sum",
+				LabelNames:  v.m.labelNames,
+				LabelValues: labelValues,
+				Value:       h.sum.Load(),
+			},
+			Sample{
+				Suffix:      "_count",
+				LabelNames:  v.m.labelNames,
+				LabelValues: labelValues,
+				Value:       float64(cumulative),
+			},
+		)
+	})
+	return []Family{f}
+}
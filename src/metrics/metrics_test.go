@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	r := &Registry{}
+
+	counter := NewCounterVec("test_requests_total", "Requests.", "route", "status")
+	r.Register(counter)
+	counter.With("/b", "200").Add(2)
+	counter.With("/a", "500").Inc()
+	counter.With("/a", "200").Inc()
+
+	gauge := NewGaugeVec("test_in_flight", "In flight.\nSecond line.")
+	r.Register(gauge)
+	gauge.With().Inc()
+	gauge.With().Inc()
+	gauge.With().Dec()
+
+	r.Register(NewGaugeFunc("test_func", "", func() float64 { return 1.5 }))
+
+	quoted := NewCounterVec("test_quoted_total", "Quoted.", "value")
+	r.Register(quoted)
+	quoted.With(`say "hi"\`).Inc()
+
+	var out strings.Builder
+	assert.Nil(t, r.WritePrometheus(&out))
+	assert.Equal(t, `# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{route="/a",status="200"} 1
+test_requests_total{route="/a",status="500"} 1
+test_requests_total{route="/b",status="200"} 2
+# HELP test_in_flight In flight.\nSecond line.
+# TYPE test_in_flight gauge
+test_in_flight 1
+# TYPE test_func gauge
+test_func 1.5
+# HELP test_quoted_total Quoted.
+# TYPE test_quoted_total counter
+test_quoted_total{value="say \"hi\"\\"} 1
+`, out.String())
+}
+
+func TestHistogram(t *testing.T) {
+	r := &Registry{}
+	h := NewHistogramVec("test_duration_seconds", "Durations.", []float64{0.1, 1}, "route")
+	r.Register(h)
+	h.With("/").Observe(0.05)
+	h.With("/").Observe(0.1) // Upper bounds are inclusive
+	h.With("/").Observe(0.5)
+	h.With("/").Observe(3)
+
+	var out strings.Builder
+	assert.Nil(t, r.WritePrometheus(&out))
+	assert.Equal(t, `# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{route="/",le="0.1"} 2
+test_duration_seconds_bucket{route="/",le="1"} 3
+test_duration_seconds_bucket{route="/",le="+Inf"} 4
+test_duration_seconds_sum{route="/"} 3.65
+test_duration_seconds_count{route="/"} 4
+`, out.String())
+}
+
+func TestWrongLabelCount(t *testing.T) {
+	counter := NewCounterVec("test_total", "", "a", "b")
+	assert.Panics(t, func() { counter.With("only one") })
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"runtime"
+	"time"
+)
+
+var processStartTime = time.Now()
+
+// Reports basic Go runtime and process stats, using the same names as the
+// official Prometheus client so that existing dashboards work.
+type runtimeCollector struct{}
+
+func (runtimeCollector) Collect() []Family {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	gauge := func(name, help string, v float64) Family {
+		return Family{Name: name, Help: help, Type: TypeGauge, Samples: []Sample{{Value: v}}}
+	}
+	counter := func(name, help string, v float64) Family {
+		return Family{Name: name, Help: help, Type: TypeCounter, Samples: []Sample{{Value: v}}}
+	}
+
+	return []Family{
+		{
+			Name: "go_info",
+			Help: "Information about the Go environment.",
+			Type: TypeGauge,
+			Samples: []Sample{{
+				LabelNames:  []string{"version"},
+				LabelValues: []string{runtime.Version()},
+				Value:       1,
+			}},
+		},
+		gauge("go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine())),
+		gauge("go_threads", "Number of OS threads created.", float64(threadCount())),
+		gauge("go_memstats_heap_alloc_bytes", "Number of heap bytes allocated and still in use.", float64(mem.HeapAlloc)),
+		gauge("go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", float64(mem.HeapInuse)),
+		gauge("go_memstats_heap_objects", "Number of allocated objects.", float64(mem.HeapObjects)),
+		gauge("go_memstats_sys_bytes", "Number of bytes obtained from system.", float64(mem.Sys)),
+		counter("go_memstats_alloc_bytes_total", "Total number of bytes allocated, even if freed.", float64(mem.TotalAlloc)),
+		counter("go_memstats_mallocs_total", "Total number of mallocs.", float64(mem.Mallocs)),
+		counter("go_memstats_frees_total", "Total number of frees.", float64(mem.Frees)),
+		counter("go_gc_cycles_total", "Number of completed GC cycles.", float64(mem.NumGC)),
+		counter("go_gc_pause_seconds_total", "Total time spent in GC stop-the-world pauses.", time.Duration(mem.PauseTotalNs).Seconds()),
+		gauge("go_memstats_last_gc_time_seconds", "Number of seconds since 1970 of last garbage collection.", float64(mem.LastGC)/1e9),
+		gauge("process_start_time_seconds", "Start time of the process since unix epoch in seconds.", float64(processStartTime.UnixNano())/1e9),
+	}
+}
+
+func threadCount() int {
+	n, _ := runtime.ThreadCreateProfile(nil)
+	return n
+}
+
+func init() {
+	Default.Register(runtimeCollector{})
+}
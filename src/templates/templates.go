@@ -6,6 +6,7 @@ import (
 	"hsf/src/ee"
 	"hsf/src/jobs"
 	"hsf/src/logging"
+	"hsf/src/metrics"
 	"html/template"
 	"io"
 	"io/fs"
@@ -25,20 +26,45 @@ var allTemplates map[string]*template.Template
 
 var ErrTemplateNotFound = errors.New("template not found")
 
+var renderDuration = metrics.Register(metrics.NewHistogramVec(
+	"hsf_template_render_duration_seconds",
+	"Time taken to render templates.",
+	[]float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25},
+	"template",
+))
+var reloads = metrics.Register(metrics.NewCounterVec(
+	"hsf_template_reloads_total",
+	"Template reloads by the template watcher, by result.",
+	"result",
+))
+
 func Render(wr io.Writer, name string, data any) error {
 	template, ok := allTemplates[name]
 	if !ok {
 		return ee.New(ErrTemplateNotFound, "trying to load template %s", name)
 	}
+	start := time.Now()
+	defer func() {
+		renderDuration.With(name).Observe(time.Since(start).Seconds())
+	}()
 	return template.Execute(wr, data)
 }
 
+// Reports whether templates have been loaded and Render can be used.
+func Loaded() bool {
+	templateReloadMutex.Lock()
+	defer templateReloadMutex.Unlock()
+	return allTemplates != nil
+}
+
 func LoadEmbedded() {
-	var err error
-	allTemplates, err = ReloadTemplates(embeddedTemplateFs)
+	newTemplates, err := ReloadTemplates(embeddedTemplateFs)
 	if err != nil {
 		panic(err)
 	}
+	templateReloadMutex.Lock()
+	allTemplates = newTemplates
+	templateReloadMutex.Unlock()
 	logging.Debug().Msg("Loaded embedded templates")
 }
 
@@ -75,23 +101,39 @@ func ReloadTemplates(templateFS fs.FS) (map[string]*template.Template, error) {
 }
 
 // WatchTemplates Watches the files/ folder for changes and reloads templates.
+// If the watcher fails, it is restarted after a few seconds, backing off if it
+// keeps failing.
 func WatchTemplates() *jobs.Job {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		panic(err)
-	}
-
 	baseDir := path.Join("src", "templates")
 	watchFS := os.DirFS(baseDir)
 
-	debouncer := time.NewTimer(time.Minute)
-	debouncer.Stop()
-	debouncerRunning := false
+	return jobs.New("Template watcher").RunWithOptions(jobs.RunOptions{Restart: jobs.RestartOnFailure, RestartDelay: 5 * time.Second}, func(job *jobs.Job) error {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return ee.New(err, "failed to create template watcher")
+		}
+		defer watcher.Close()
+
+		err = fs.WalkDir(watchFS, "files", func(filename string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				err = watcher.Add(path.Join(baseDir, filename))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return ee.New(err, "failed to watch template directories")
+		}
 
-	job := jobs.New("Template watcher")
+		debouncer := time.NewTimer(time.Minute)
+		debouncer.Stop()
+		debouncerRunning := false
 
-	go func() {
-		defer watcher.Close()
 		for {
 			select {
 			case <-watcher.Events:
@@ -100,43 +142,27 @@ func WatchTemplates() *jobs.Job {
 				}
 				debouncerRunning = true
 				debouncer.Reset(time.Millisecond * 20)
-			case err = <-watcher.Errors:
-				panic(err)
+			case err := <-watcher.Errors:
+				return ee.New(err, "template watcher failed")
 			case <-debouncer.C:
 				debouncerRunning = false
 				newTemplates, err := ReloadTemplates(watchFS)
 				if err != nil {
+					reloads.With("failure").Inc()
 					logging.Error().Err(err).Msg("Failed to reload templates")
 				} else {
+					reloads.With("success").Inc()
 					templateReloadMutex.Lock()
 					allTemplates = newTemplates
 					templateReloadMutex.Unlock()
 					logging.Debug().Msg("Reloaded templates")
 				}
-			case <-job.Ctx.Done():
+			case <-job.Canceled():
 				logging.Info().Msg("Shutting down template watcher")
-				job.Finish()
-				return
+				return nil
 			}
 		}
-	}()
-
-	err = fs.WalkDir(watchFS, "files", func(filename string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if d.IsDir() {
-			err = watcher.Add(path.Join(baseDir, filename))
-			if err != nil {
-				return err
-			}
-		}
-		return nil
 	})
-	if err != nil {
-		panic(err)
-	}
-	return job
 }
 
 var hsfTemplateFuncs = map[string]any{}
@@ -0,0 +1,325 @@
+package website
+
+import (
+	"encoding/json"
+	"fmt"
+	"hsf/src/config"
+	"hsf/src/ee"
+	"hsf/src/logging"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * The access log records one entry per request, separately from the
+ * application log's messages about what went on while handling it. By
+ * default, entries go to the application log as structured fields; set
+ * config.Config.AccessLog.File to write them to their own file, in the
+ * Combined Log Format understood by most log analyzers, or as JSON lines.
+ *
+ * URLs regularly carry secrets (password reset tokens, OAuth codes, API
+ * keys), and log files tend to be copied around and kept for a long time, so
+ * sensitive query parameters and path segments are redacted before they are
+ * written. See config.AccessLogConfig.
+ */
+
+const redacted = "REDACTED"
+
+type accessLogEntry struct {
+	Time      time.Time     `json:"time"`
+	RequestID string        `json:"request_id"`
+	IP        string        `json:"ip"`
+	Method    string        `json:"method"`
+	Path      string        `json:"path"` // Includes the query string
+	Proto     string        `json:"proto"`
+	Route     string        `json:"route"`
+	Status    int           `json:"status"` // 0 if the response was proxied or hijacked
+	Bytes     int64         `json:"bytes"`
+	Duration  time.Duration `json:"-"`
+	UserAgent string        `json:"user_agent"`
+	Referrer  string        `json:"referrer"`
+}
+
+type AccessLogger struct {
+	cfg config.AccessLogConfig
+
+	toAppLog bool // Log structured fields to the application log instead of out
+
+	mu   sync.Mutex
+	out  io.Writer
+	file *os.File // Closed by Close, if we opened it
+}
+
+func NewAccessLogger(cfg config.AccessLogConfig) (*AccessLogger, error) {
+	cfg = cfg.WithDefaults()
+	if cfg.Format != config.AccessLogCombined && cfg.Format != config.AccessLogJSON {
+		return nil, ee.New(nil, "unknown access log format %q", cfg.Format)
+	}
+
+	al := &AccessLogger{cfg: cfg}
+	switch cfg.File {
+	case "":
+		al.toAppLog = true
+	case "-":
+		al.out = os.Stdout
+	default:
+		f, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+		if err != nil {
+			return nil, ee.New(err, "failed to open access log %s", cfg.File)
+		}
+		al.out = f
+		al.file = f
+	}
+
+	return al, nil
+}
+
+// Reopens the access log file, e.g. after logrotate has moved it.
+func (al *AccessLogger) Reopen() error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.file == nil {
+		return nil
+	}
+
+	f, err := os.OpenFile(al.cfg.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return ee.New(err, "failed to reopen access log %s", al.cfg.File)
+	}
+	al.file.Close()
+	al.out = f
+	al.file = f
+	return nil
+}
+
+func (al *AccessLogger) Close() error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.file == nil {
+		return nil
+	}
+	err := al.file.Close()
+	al.file = nil
+	al.out = nil
+	return err
+}
+
+func (al *AccessLogger) Log(e accessLogEntry) {
+	if al.toAppLog {
+		logging.Unsampled().Info().Timestamp().
+			Str("RequestID", e.RequestID).
+			Str("IP", e.IP).
+			Str("Method", e.Method).
+			Str("Path", e.Path).
+			Str("Route", e.Route).
+			Int("Status", e.Status).
+			Int64("Bytes", e.Bytes).
+			Dur("Duration", e.Duration).
+			Str("UserAgent", e.UserAgent).
+			Str("Referrer", e.Referrer).
+			Msg("Served request")
+		return
+	}
+
+	var line []byte
+	if al.cfg.Format == config.AccessLogJSON {
+		line = formatAccessLogJSON(e)
+	} else {
+		line = formatAccessLogCombined(e)
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.out == nil {
+		return // Closed during shutdown
+	}
+	if _, err := al.out.Write(line); err != nil {
+		logging.Error().Err(err).Msg("Failed to write access log")
+	}
+}
+
+// Writes an access log entry for every request.
+func MiddlewareAccessLog(al *AccessLogger) Middleware {
+	return func(h Handler) Handler {
+		return func(c *RequestContext) ResponseData {
+			res := h(c)
+
+			e := accessLogEntry{
+				Time:      c.RequestStartTime,
+				RequestID: c.RequestID,
+				Method:    c.Req.Method,
+				Path:      al.redactURL(c.Req.URL.Path, c.Req.URL.RawQuery),
+				Proto:     c.Req.Proto,
+				Route:     c.routePattern,
+				Duration:  time.Since(c.RequestStartTime),
+				UserAgent: c.Req.UserAgent(),
+				Referrer:  al.redactReferrer(c.Req.Referer()),
+			}
+			if ip := ReqGetIP(c.Req); ip != nil {
+				e.IP = ip.Addr().String()
+			}
+			if !res.Proxied {
+				e.Status = res.StatusCode
+				if e.Status == 0 {
+					e.Status = http.StatusOK
+				}
+				e.Bytes = responseSize(c, &res)
+			}
+			al.Log(e)
+
+			return res
+		}
+	}
+}
+
+// The number of body bytes that doRequest will send.
+func responseSize(c *RequestContext, res *ResponseData) int64 {
+	if c.Req.Method == http.MethodHead {
+		return 0
+	}
+	if n, err := strconv.ParseInt(res.Header().Get("Content-Length"), 10, 64); err == nil {
+		return n
+	}
+	if res.Body != nil {
+		return int64(res.Body.Len())
+	}
+	return 0
+}
+
+func (al *AccessLogger) redactURL(path string, rawQuery string) string {
+	for _, re := range al.cfg.RedactPaths {
+		path = redactSubmatches(re, path)
+	}
+	if rawQuery == "" {
+		return path
+	}
+	return path + "?" + al.redactQuery(rawQuery)
+}
+
+// Replaces the text matched by each capture group of re.
+func redactSubmatches(re *regexp.Regexp, s string) string {
+	loc := re.FindStringSubmatchIndex(s)
+	if loc == nil {
+		return s
+	}
+
+	var b strings.Builder
+	last := 0
+	for i := 2; i+1 < len(loc); i += 2 {
+		start, end := loc[i], loc[i+1]
+		if start < last || start < 0 {
+			continue // Group did not participate, or is nested in one we already redacted
+		}
+		b.WriteString(s[last:start])
+		b.WriteString(redacted)
+		last = end
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// Redacts values of sensitive parameters, leaving the rest of the query
+// string untouched (including its order and encoding).
+func (al *AccessLogger) redactQuery(rawQuery string) string {
+	pairs := strings.Split(rawQuery, "&")
+	for i, pair := range pairs {
+		rawKey, _, hasValue := strings.Cut(pair, "=")
+		if !hasValue {
+			continue
+		}
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil {
+			key = rawKey
+		}
+		for _, sensitive := range al.cfg.RedactQueryParams {
+			if strings.EqualFold(key, sensitive) {
+				pairs[i] = rawKey + "=" + redacted
+				break
+			}
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// Referrers are redacted too. A page on our own site with a secret in its
+// URL would otherwise leak it via the Referer of every link clicked there.
+func (al *AccessLogger) redactReferrer(referrer string) string {
+	u, err := url.Parse(referrer)
+	if err != nil {
+		return referrer
+	}
+	for _, re := range al.cfg.RedactPaths {
+		u.Path = redactSubmatches(re, u.Path)
+	}
+	u.RawPath = ""
+	u.RawQuery = al.redactQuery(u.RawQuery)
+	return u.String()
+}
+
+// Formats an entry in the Combined Log Format:
+//
+//	ip - - [time] "method path proto" status bytes "referrer" "user agent"
+func formatAccessLogCombined(e accessLogEntry) []byte {
+	var b strings.Builder
+	b.WriteString(clfField(e.IP))
+	b.WriteString(" - - [")
+	b.WriteString(e.Time.Format("02/Jan/2006:15:04:05 -0700"))
+	b.WriteString(`] "`)
+	b.WriteString(clfEscape(e.Method + " " + e.Path + " " + e.Proto))
+	b.WriteString(`" `)
+	if e.Status == 0 {
+		b.WriteString("- -")
+	} else {
+		fmt.Fprintf(&b, "%d %d", e.Status, e.Bytes)
+	}
+	b.WriteString(` "`)
+	b.WriteString(clfEscape(clfField(e.Referrer)))
+	b.WriteString(`" "`)
+	b.WriteString(clfEscape(clfField(e.UserAgent)))
+	b.WriteString("\"\n")
+	return []byte(b.String())
+}
+
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// Escapes quotes, backslashes, and control characters, so that a malicious
+// user agent can't forge log lines.
+func clfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func formatAccessLogJSON(e accessLogEntry) []byte {
+	// Durations are in milliseconds, which is what most log tools expect
+	line, _ := json.Marshal(struct {
+		accessLogEntry
+		DurationMs float64 `json:"duration_ms"`
+	}{
+		accessLogEntry: e,
+		DurationMs:     float64(e.Duration.Microseconds()) / 1000,
+	})
+	return append(line, '\n')
+}
@@ -0,0 +1,83 @@
+package website
+
+import (
+	"encoding/json"
+	"hsf/src/config"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessLogRedaction(t *testing.T) {
+	al, err := NewAccessLogger(config.AccessLogConfig{
+		File: "-",
+		RedactPaths: []*regexp.Regexp{
+			regexp.MustCompile(`^/reset-password/([^/]+)`),
+		},
+	})
+	assert.Nil(t, err)
+
+	assert.Equal(t, "/about", al.redactURL("/about", ""))
+	assert.Equal(t, "/search?q=cats&page=2", al.redactURL("/search", "q=cats&page=2"))
+	assert.Equal(t, "/login?next=%2F&Password=REDACTED&flag", al.redactURL("/login", "next=%2F&Password=hunter2&flag"))
+	assert.Equal(t, "/reset-password/REDACTED/done", al.redactURL("/reset-password/abc123/done", ""))
+	assert.Equal(t,
+		"https://example.com/reset-password/REDACTED?token=REDACTED",
+		al.redactReferrer("https://example.com/reset-password/abc123?token=xyz"),
+	)
+	assert.Equal(t, "", al.redactReferrer(""))
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	e := accessLogEntry{
+		Time:      time.Date(2024, 3, 5, 14, 7, 9, 0, time.FixedZone("", -7*60*60)),
+		RequestID: "abc",
+		IP:        "203.0.113.9",
+		Method:    http.MethodGet,
+		Path:      "/search?q=1",
+		Proto:     "HTTP/1.1",
+		Route:     "^/search$",
+		Status:    200,
+		Bytes:     1234,
+		Duration:  1500 * time.Microsecond,
+		UserAgent: "evil\"agent\n",
+	}
+
+	assert.Equal(t,
+		`203.0.113.9 - - [05/Mar/2024:14:07:09 -0700] "GET /search?q=1 HTTP/1.1" 200 1234 "-" "evil\"agent\x0a"`+"\n",
+		string(formatAccessLogCombined(e)),
+	)
+
+	var decoded map[string]any
+	assert.Nil(t, json.Unmarshal(formatAccessLogJSON(e), &decoded))
+	assert.Equal(t, "abc", decoded["request_id"])
+	assert.Equal(t, float64(200), decoded["status"])
+	assert.Equal(t, 1.5, decoded["duration_ms"])
+}
+
+func TestMiddlewareAccessLog(t *testing.T) {
+	var out strings.Builder
+	al, err := NewAccessLogger(config.AccessLogConfig{Format: config.AccessLogJSON})
+	assert.Nil(t, err)
+	al.toAppLog = false
+	al.out = &out
+
+	c := newTestContext(http.MethodGet, nil)
+	c.Req.RemoteAddr = "192.0.2.1:1234"
+	c.Req.URL.RawQuery = "token=secret"
+	c.RequestID = "req-1"
+	MiddlewareAccessLog(al)(func(c *RequestContext) ResponseData {
+		return renderText(c, "hello")
+	})(c)
+
+	var decoded map[string]any
+	assert.Nil(t, json.Unmarshal([]byte(out.String()), &decoded))
+	assert.Equal(t, "req-1", decoded["request_id"])
+	assert.Equal(t, "192.0.2.1", decoded["ip"])
+	assert.Equal(t, "/?token=REDACTED", decoded["path"])
+	assert.Equal(t, float64(5), decoded["bytes"])
+}
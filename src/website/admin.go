@@ -0,0 +1,201 @@
+package website
+
+import (
+	"hsf/src/errreport"
+	"hsf/src/jobs"
+	"hsf/src/metrics"
+	"hsf/src/templates"
+	"net/http"
+	"net/http/pprof"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * The admin server runs on its own listener, separate from the public
+ * website, and is bound to localhost by default. It provides:
+ *
+ * - /healthz: always 200 while the process is able to serve requests.
+ *   Suitable for a liveness check.
+ * - /readyz: 200 once templates are loaded, 503 once shutdown begins.
+ *   Suitable for a load balancer deciding whether to send us traffic.
+ * - /errors: internal server errors grouped by src/errreport, as HTML or JSON.
+ * - /logs: recent log entries, with a live tail (see adminlogs.go).
+ * - /metrics: metrics in the Prometheus text format (see src/metrics).
+ * - /debug/pprof/: the standard Go profiler endpoints.
+ * - /status: a summary of the process's runtime state, as HTML or JSON.
+ *
+ * Nothing here is authenticated, so do not expose the admin listener to the
+ * internet.
+ */
+
+// State of the running server, shared with the admin routes.
+type serverStatus struct {
+	StartTime           time.Time
+	ShuttingDown        atomic.Bool
+	LongRunningRequests *LongRunningRequestTracker
+	Conns               *connCounter
+	Jobs                jobs.Jobs
+}
+
+func AdminRoutes(status *serverStatus) http.Handler {
+	router := &Router{}
+	routes := RouteBuilder{
+		Router: router,
+		Middlewares: []Middleware{
+			MiddlewareRecoverPanics,
+		},
+	}
+
+	routes.GET(regexp.MustCompile(`^/healthz$`), func(c *RequestContext) ResponseData {
+		return renderText(c, "ok\n")
+	})
+	routes.GET(regexp.MustCompile(`^/readyz$`), func(c *RequestContext) ResponseData {
+		var res ResponseData
+		if status.ShuttingDown.Load() {
+			res = renderText(c, "shutting down\n")
+			res.StatusCode = http.StatusServiceUnavailable
+		} else if !templates.Loaded() {
+			res = renderText(c, "templates not loaded\n")
+			res.StatusCode = http.StatusServiceUnavailable
+		} else {
+			res = renderText(c, "ok\n")
+		}
+		return res
+	})
+	routes.GET(regexp.MustCompile(`^/status$`), func(c *RequestContext) ResponseData {
+		data := status.Snapshot()
+		return c.Negotiate(
+			OfferHTML("adminstatus", data),
+			OfferJSON(data),
+		)
+	})
+
+	routes.GET(regexp.MustCompile(`^/errors$`), func(c *RequestContext) ResponseData {
+		groups := errreport.Default.Groups()
+		return c.Negotiate(
+			OfferHTML("adminerrors", groups),
+			OfferJSON(groups),
+		)
+	})
+	routes.GET(regexp.MustCompile(`^/logs$`), AdminLogsPage)
+	routes.GET(regexp.MustCompile(`^/logs/stream$`), AdminLogsStream)
+	routes.GET(regexp.MustCompile(`^/metrics$`), func(c *RequestContext) ResponseData {
+		var res ResponseData
+		res.Header().Set("Content-Type", metrics.ContentType)
+		metrics.WritePrometheus(&res) // Writing to a buffer can't fail
+		return res
+	})
+
+	pprofRoutes := routes.Group(regexp.MustCompile(`^/debug/pprof`))
+	pprofRoutes.GET(regexp.MustCompile(`^/cmdline$`), wrapHandlerFunc(pprof.Cmdline))
+	pprofRoutes.GET(regexp.MustCompile(`^/profile$`), wrapHandlerFunc(pprof.Profile))
+	pprofRoutes.AnyMethod(regexp.MustCompile(`^/symbol$`), wrapHandlerFunc(pprof.Symbol))
+	pprofRoutes.GET(regexp.MustCompile(`^/trace$`), wrapHandlerFunc(pprof.Trace))
+	// Index also serves the named profiles, e.g. /debug/pprof/heap
+	pprofRoutes.GET(regexp.MustCompile(`^/.*$`), wrapHandlerFunc(pprof.Index))
+
+	routes.AnyMethod(regexp.MustCompile(`^.*$`), func(c *RequestContext) ResponseData {
+		res := renderText(c, "not found\n")
+		res.StatusCode = http.StatusNotFound
+		return res
+	})
+
+	return router
+}
+
+// Adapts a standard library handler to our Handler type. The response is
+// buffered like any other.
+func wrapHandlerFunc(h http.HandlerFunc) Handler {
+	return func(c *RequestContext) ResponseData {
+		var res ResponseData
+		h(&res, c.Req)
+		return res
+	}
+}
+
+type statusData struct {
+	Uptime       string
+	ShuttingDown bool
+	Templates    bool
+
+	GoVersion   string
+	OS          string
+	Arch        string
+	VCSRevision string
+	VCSModified bool
+
+	Goroutines     int
+	HeapAlloc      uint64
+	HeapObjects    uint64
+	Sys            uint64
+	NumGC          uint32
+	GCPauseTotal   string
+	LastGC         string
+	OpenConns      int
+	LongRunning    int
+	UnfinishedJobs []string
+	Jobs           []jobStatus
+}
+
+type jobStatus struct {
+	Name      string
+	State     jobs.State
+	Restarts  int
+	LastError string
+}
+
+func (s *serverStatus) Snapshot() statusData {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	data := statusData{
+		Uptime:       time.Since(s.StartTime).Round(time.Second).String(),
+		ShuttingDown: s.ShuttingDown.Load(),
+		Templates:    templates.Loaded(),
+
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+
+		Goroutines:     runtime.NumGoroutine(),
+		HeapAlloc:      mem.HeapAlloc,
+		HeapObjects:    mem.HeapObjects,
+		Sys:            mem.Sys,
+		NumGC:          mem.NumGC,
+		GCPauseTotal:   time.Duration(mem.PauseTotalNs).String(),
+		OpenConns:      s.Conns.Open(),
+		LongRunning:    s.LongRunningRequests.Running(),
+		UnfinishedJobs: s.Jobs.ListUnfinished(),
+	}
+	for _, job := range s.Jobs {
+		js := jobStatus{
+			Name:     job.Name,
+			State:    job.State(),
+			Restarts: job.Restarts(),
+		}
+		if err := job.LastError(); err != nil {
+			js.LastError = err.Error()
+		}
+		data.Jobs = append(data.Jobs, js)
+	}
+	if mem.LastGC != 0 {
+		data.LastGC = time.Unix(0, int64(mem.LastGC)).Format(time.DateTime)
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				data.VCSRevision = setting.Value
+			case "vcs.modified":
+				data.VCSModified = setting.Value == "true"
+			}
+		}
+	}
+
+	return data
+}
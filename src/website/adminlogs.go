@@ -0,0 +1,191 @@
+package website
+
+import (
+	"encoding/json"
+	"fmt"
+	"hsf/src/ee"
+	"hsf/src/logging"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+/*
+ * Admin pages for the recent log entries kept by logging.Recent:
+ *
+ * - /logs shows them as a table (or JSON), newest first, and can follow new
+ *   entries live.
+ * - /logs/stream sends new entries as server-sent events, one JSON entry per
+ *   "log" event. Reconnecting clients send Last-Event-ID and get anything
+ *   they missed that is still in the buffer.
+ *
+ * Both take the query parameters level (minimum level, default "debug"),
+ * module, and request_id.
+ */
+
+type adminLogsData struct {
+	Enabled   bool
+	Entries   []adminLogEntry
+	Level     string
+	Module    string
+	RequestID string
+	Levels    []string
+	StreamUrl string
+}
+
+type adminLogEntry struct {
+	logging.RecentEntry
+	TimeText   string
+	FieldsText string
+	StackText  string
+}
+
+var adminLogLevels = []string{"trace", "debug", "info", "warn", "error"}
+
+func recentLogFilter(req *http.Request) (logging.RecentFilter, string) {
+	query := req.URL.Query()
+	levelName := query.Get("level")
+	level, err := zerolog.ParseLevel(levelName)
+	if err != nil || levelName == "" {
+		levelName = "debug"
+		level = zerolog.DebugLevel
+	}
+	return logging.RecentFilter{
+		MinLevel:  level,
+		Module:    query.Get("module"),
+		RequestID: query.Get("request_id"),
+	}, levelName
+}
+
+func AdminLogsPage(c *RequestContext) ResponseData {
+	filter, levelName := recentLogFilter(c.Req)
+
+	data := adminLogsData{
+		Enabled:   logging.Recent != nil,
+		Level:     levelName,
+		Module:    filter.Module,
+		RequestID: filter.RequestID,
+		Levels:    adminLogLevels,
+		StreamUrl: "/logs/stream?" + c.Req.URL.RawQuery,
+	}
+	var entries []logging.RecentEntry
+	if logging.Recent != nil {
+		entries = logging.Recent.Entries(filter)
+		slices.Reverse(entries)
+	}
+	for _, e := range entries {
+		data.Entries = append(data.Entries, newAdminLogEntry(e))
+	}
+
+	return c.Negotiate(
+		OfferHTML("adminlogs", data),
+		OfferJSON(entries),
+	)
+}
+
+func newAdminLogEntry(e logging.RecentEntry) adminLogEntry {
+	res := adminLogEntry{
+		RecentEntry: e,
+		TimeText:    e.Time.Local().Format(time.DateTime),
+	}
+	if len(e.Fields) > 0 {
+		fields, _ := json.MarshalIndent(e.Fields, "", "  ")
+		res.FieldsText = string(fields)
+	}
+	var stack strings.Builder
+	writeFrames := func(frames []any, indent string) {
+		for _, frame := range frames {
+			frameMap, _ := frame.(map[string]any)
+			fmt.Fprintf(&stack, "%s%v (%v:%v)\n", indent, frameMap["function"], frameMap["file"], frameMap["line"])
+		}
+	}
+	for i, frame := range e.Stack {
+		// Multi-errors log a list of errors with their own stacks; see
+		// ee.MultiStack.
+		frameMap, _ := frame.(map[string]any)
+		if subError, ok := frameMap["error"]; ok {
+			subStack, _ := frameMap["stack"].([]any)
+			fmt.Fprintf(&stack, "[%d] %v\n", i+1, subError)
+			writeFrames(subStack, "    ")
+		} else {
+			writeFrames(e.Stack, "")
+			break
+		}
+	}
+	res.StackText = stack.String()
+	return res
+}
+
+func AdminLogsStream(c *RequestContext) ResponseData {
+	if logging.Recent == nil {
+		res := renderText(c, "recent logs are disabled\n")
+		res.StatusCode = http.StatusNotFound
+		return res
+	}
+	flusher, ok := c.Res.(http.Flusher)
+	if !ok {
+		return render500HTML(c, ee.New(nil, "response writer does not support flushing"))
+	}
+
+	filter, _ := recentLogFilter(c.Req)
+
+	// Subscribe before catching up, so that nothing falls through the cracks.
+	// Anything we see twice is skipped by checking Seq.
+	entries, unsubscribe := logging.Recent.Subscribe()
+	defer unsubscribe()
+
+	header := c.Res.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no") // Tell nginx not to buffer
+	c.Res.WriteHeader(http.StatusOK)
+
+	var lastSeq uint64
+	send := func(e logging.RecentEntry) error {
+		if e.Seq <= lastSeq {
+			return nil
+		}
+		lastSeq = e.Seq
+		if !filter.Matches(e) {
+			return nil
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(c.Res, "id: %d\nevent: log\ndata: %s\n\n", e.Seq, data)
+		return err
+	}
+
+	if lastID, err := strconv.ParseUint(c.Req.Header.Get("Last-Event-ID"), 10, 64); err == nil {
+		lastSeq = lastID
+		for _, e := range logging.Recent.Entries(logging.RecentFilter{MinLevel: zerolog.TraceLevel}) {
+			if err := send(e); err != nil {
+				return ResponseData{Proxied: true}
+			}
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		var err error
+		select {
+		case e := <-entries:
+			err = send(e)
+		case <-keepalive.C:
+			_, err = c.Res.Write([]byte(": keepalive\n\n"))
+		case <-c.Done():
+			return ResponseData{Proxied: true}
+		}
+		if err != nil {
+			return ResponseData{Proxied: true}
+		}
+		flusher.Flush()
+	}
+}
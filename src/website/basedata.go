@@ -7,14 +7,16 @@ import (
 
 type BaseData struct {
 	EsBuildSSEUrl string
+	Flashes       []Flash
 }
 
-func GetBaseData() BaseData {
+func GetBaseData(c *RequestContext) BaseData {
 	esbuildUrl := ""
 	if buildcss.ActiveServerPort != 0 {
 		esbuildUrl = fmt.Sprintf("localhost:%d", buildcss.ActiveServerPort)
 	}
 	return BaseData{
 		EsBuildSSEUrl: esbuildUrl,
+		Flashes:       c.Flashes(),
 	}
 }
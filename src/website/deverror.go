@@ -0,0 +1,202 @@
+package website
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hsf/src/ee"
+	"hsf/src/templates"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+/*
+ * In Dev, internal server errors render a detailed error page instead of the
+ * generic error500 template: the full error chain, the stack trace of every
+ * ee.Error in it with a few lines of source around each frame, and a dump of
+ * the request. This must never be shown in Beta or Live, since it leaks
+ * source code and request headers (including cookies).
+ *
+ * The error500dev template deliberately does not use the base layout, so that
+ * it keeps working while you are in the middle of breaking the layout.
+ */
+
+type devErrorData struct {
+	Errors   []devErrorLink
+	Template string // The template being rendered when the error occurred, if any
+	Request  devErrorRequest
+}
+
+type devErrorLink struct {
+	Type    string
+	Message string
+	Details []devErrorKV // Kind, user message and context, for ee.Errors
+	Frames  []devErrorFrame
+}
+
+type devErrorFrame struct {
+	Function string
+	File     string
+	Line     int
+	Source   []devErrorSourceLine
+}
+
+type devErrorSourceLine struct {
+	Number  int
+	Text    string
+	Current bool
+}
+
+type devErrorRequest struct {
+	Method     string
+	Url        string
+	Proto      string
+	RemoteAddr string
+	Headers    []devErrorKV
+	PathParams []devErrorKV
+	Query      []devErrorKV
+}
+
+type devErrorKV struct {
+	Name  string
+	Value string
+}
+
+// Lines of source to show on either side of the line in a stack frame.
+const devErrorSourceContext = 3
+
+func renderDevError500HTML(c *RequestContext, err error) (ResponseData, error) {
+	res := ResponseData{
+		StatusCode: http.StatusInternalServerError,
+	}
+
+	data := devErrorData{
+		Errors:   devErrorChain(err),
+		Template: c.currentTemplate,
+		Request:  devErrorDumpRequest(c),
+	}
+
+	renderErr := templates.Render(&res, "error500dev", data)
+	if renderErr != nil {
+		return ResponseData{}, renderErr
+	}
+
+	return res, nil
+}
+
+func devErrorChain(err error) []devErrorLink {
+	wd, _ := os.Getwd()
+
+	var chain []devErrorLink
+	for ; err != nil; err = errors.Unwrap(err) {
+		link := devErrorLink{
+			Type: fmt.Sprintf("%T", err),
+		}
+
+		if multi, ok := err.(*ee.MultiError); ok {
+			link.Message = fmt.Sprintf("%d errors, listed below", len(multi.Errors))
+		} else if asEE, ok := err.(*ee.Error); ok {
+			link.Message = asEE.Message
+			link.Details = devErrorDetails(asEE)
+			for _, frame := range asEE.Stack.Frames() {
+				link.Frames = append(link.Frames, devErrorFrame{
+					Function: frame.Function,
+					File:     strings.Replace(frame.File, wd, ".", 1),
+					Line:     frame.Line,
+					Source:   devErrorSource(frame.File, frame.Line),
+				})
+			}
+		} else {
+			link.Message = err.Error()
+		}
+
+		chain = append(chain, link)
+
+		// errors.Unwrap stops at multi-errors, so follow each of their
+		// errors ourselves.
+		if subErrs, ok := err.(interface{ Unwrap() []error }); ok {
+			for _, sub := range subErrs.Unwrap() {
+				chain = append(chain, devErrorChain(sub)...)
+			}
+		}
+	}
+
+	return chain
+}
+
+func devErrorDetails(err *ee.Error) []devErrorKV {
+	var details []devErrorKV
+	if err.Kind != ee.KindUnknown {
+		details = append(details, devErrorKV{Name: "Kind", Value: err.Kind.String()})
+	}
+	if err.UserMessage != "" {
+		details = append(details, devErrorKV{Name: "User message", Value: err.UserMessage})
+	}
+	var context []devErrorKV
+	for name, val := range err.Context {
+		context = append(context, devErrorKV{Name: name, Value: fmt.Sprint(val)})
+	}
+	sort.Slice(context, func(i, j int) bool {
+		return context[i].Name < context[j].Name
+	})
+	return append(details, context...)
+}
+
+func devErrorSource(filename string, line int) []devErrorSourceLine {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var result []devErrorSourceLine
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		if lineNum < line-devErrorSourceContext {
+			continue
+		}
+		if lineNum > line+devErrorSourceContext {
+			break
+		}
+		result = append(result, devErrorSourceLine{
+			Number:  lineNum,
+			Text:    scanner.Text(),
+			Current: lineNum == line,
+		})
+	}
+
+	return result
+}
+
+func devErrorDumpRequest(c *RequestContext) devErrorRequest {
+	req := devErrorRequest{
+		Method:     c.Req.Method,
+		Url:        ReqFullUrl(c.Req),
+		Proto:      c.Req.Proto,
+		RemoteAddr: c.Req.RemoteAddr,
+	}
+
+	for name, vals := range c.Req.Header {
+		for _, val := range vals {
+			req.Headers = append(req.Headers, devErrorKV{Name: name, Value: val})
+		}
+	}
+	for name, val := range c.PathParams {
+		req.PathParams = append(req.PathParams, devErrorKV{Name: name, Value: val})
+	}
+	for name, vals := range c.Req.URL.Query() {
+		for _, val := range vals {
+			req.Query = append(req.Query, devErrorKV{Name: name, Value: val})
+		}
+	}
+
+	for _, kvs := range [][]devErrorKV{req.Headers, req.PathParams, req.Query} {
+		sort.SliceStable(kvs, func(i, j int) bool {
+			return kvs[i].Name < kvs[j].Name
+		})
+	}
+
+	return req
+}
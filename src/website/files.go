@@ -0,0 +1,460 @@
+package website
+
+import (
+	"errors"
+	"fmt"
+	"hsf/src/ee"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Most responses are small and are rendered straight into ResponseData.Body.
+ * Files, on the other hand, can be very large (conference videos, PDFs), and
+ * clients expect to be able to resume downloads and seek through them. The
+ * ServeContent and ServeFile helpers produce a ResponseData that streams from
+ * a file instead of a buffer, with support for:
+ *
+ * - Conditional requests (If-Match, If-None-Match, If-Modified-Since, etc.)
+ * - Range requests, including If-Range and multipart/byteranges
+ * - Content-Disposition attachments
+ *
+ * The status code and headers are worked out in the handler, so middleware
+ * sees an ordinary ResponseData and logs the real status code. The content
+ * itself is not read until doRequest sends it. When the content is an *os.File
+ * and only one range is requested, the copy is handed to the http package as
+ * a plain reader, which lets it use sendfile where the OS supports it.
+ *
+ * This is the same job http.ServeContent does, but http.ServeContent writes
+ * directly to the connection and so cannot be used with our buffered
+ * responses or middleware.
+ */
+
+type ContentOptions struct {
+	// An entity tag for the content, including quotes, e.g. `"v1.2"` or
+	// `W/"abc"`. Used to answer If-Match, If-None-Match, and If-Range. Leave
+	// empty if you don't have a cheap way to compute one; the modification time
+	// will be used instead.
+	ETag string
+
+	// If set, the browser will download the content as a file with this name
+	// instead of displaying it.
+	AttachmentName string
+}
+
+type byteRange struct {
+	Start, Length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.Start+r.Length-1, size)
+}
+
+func (r byteRange) mimeHeader(contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {r.contentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+type fileContent struct {
+	content     io.ReadSeeker
+	size        int64
+	contentType string
+
+	// Empty to send the whole content. More than one range results in a
+	// multipart/byteranges response.
+	ranges   []byteRange
+	boundary string
+}
+
+// If a client asks for more ranges than this, we assume it is up to no good
+// and send the whole file instead.
+const maxRanges = 100
+
+// Opens a file from disk and serves it with ServeContent. Responds with 404 if
+// the file does not exist or is a directory.
+func (c *RequestContext) ServeFile(filename string, opts ContentOptions) ResponseData {
+	f, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return render404HTML(c)
+	} else if err != nil {
+		return render500HTML(c, ee.New(err, "failed to open file %s", filename))
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return render500HTML(c, ee.New(err, "failed to stat file %s", filename))
+	}
+	if info.IsDir() {
+		f.Close()
+		return render404HTML(c)
+	}
+
+	return c.ServeContent(info.Name(), info.ModTime(), f, opts)
+}
+
+// Serves content with support for conditional and range requests. The name is
+// used to determine the Content-Type if one is not already known, and modtime
+// is used for Last-Modified and conditional requests (pass the zero time if
+// unknown). If content is an io.Closer, it will be closed once the response
+// has been sent.
+func (c *RequestContext) ServeContent(name string, modtime time.Time, content io.ReadSeeker, opts ContentOptions) ResponseData {
+	res := ResponseData{
+		StatusCode: http.StatusOK,
+	}
+
+	size, err := content.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = content.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		closeContent(content)
+		return render500HTML(c, ee.New(err, "failed to seek content for %s", name))
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		var sniffBuf [512]byte
+		n, _ := io.ReadFull(content, sniffBuf[:])
+		contentType = http.DetectContentType(sniffBuf[:n])
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			closeContent(content)
+			return render500HTML(c, ee.New(err, "failed to seek content for %s", name))
+		}
+	}
+
+	if opts.ETag != "" {
+		res.Header().Set("ETag", opts.ETag)
+	}
+	if !isZeroTime(modtime) {
+		res.Header().Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	}
+	if opts.AttachmentName != "" {
+		res.SetAttachment(opts.AttachmentName)
+	}
+
+	if status := checkPreconditions(c.Req, opts.ETag, modtime); status != 0 {
+		closeContent(content)
+		res.StatusCode = status
+		return res
+	}
+
+	file := &fileContent{
+		content:     content,
+		size:        size,
+		contentType: contentType,
+	}
+	res.file = file
+	res.Header().Set("Accept-Ranges", "bytes")
+	res.Header().Set("Content-Type", contentType)
+	res.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+
+	rangeHeader := c.Req.Header.Get("Range")
+	if rangeHeader == "" || (c.Req.Method != http.MethodGet && c.Req.Method != http.MethodHead) {
+		return res
+	}
+	if !ifRangeMatches(c.Req, opts.ETag, modtime) {
+		return res
+	}
+
+	ranges, err := parseRange(rangeHeader, size)
+	if err != nil {
+		closeContent(content)
+		res.file = nil
+		res.StatusCode = http.StatusRequestedRangeNotSatisfiable
+		res.Header().Del("Content-Length")
+		res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		res.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		res.Write([]byte(err.Error()))
+		return res
+	}
+
+	var totalLength int64
+	for _, ra := range ranges {
+		totalLength += ra.Length
+	}
+	if len(ranges) > maxRanges || totalLength > size {
+		// Overlapping or excessive ranges; sending the whole thing is cheaper
+		// and harmless.
+		return res
+	}
+
+	res.StatusCode = http.StatusPartialContent
+	file.ranges = ranges
+	if len(ranges) == 1 {
+		res.Header().Set("Content-Range", ranges[0].contentRange(size))
+		res.Header().Set("Content-Length", strconv.FormatInt(ranges[0].Length, 10))
+	} else {
+		file.boundary = multipart.NewWriter(io.Discard).Boundary()
+		res.Header().Set("Content-Type", "multipart/byteranges; boundary="+file.boundary)
+		res.Header().Set("Content-Length", strconv.FormatInt(file.multipartLength(), 10))
+	}
+
+	return res
+}
+
+// Sets Content-Disposition so that the browser downloads the response as a
+// file with the given name instead of displaying it.
+func (rd *ResponseData) SetAttachment(filename string) {
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+	if disposition == "" {
+		// The name had characters that can't be encoded; let the browser pick.
+		disposition = "attachment"
+	}
+	rd.Header().Set("Content-Disposition", disposition)
+}
+
+// Writes the file content to rw. Headers must already have been sent.
+func (f *fileContent) send(rw io.Writer) error {
+	if len(f.ranges) == 0 {
+		return f.copyRange(rw, byteRange{Start: 0, Length: f.size})
+	} else if len(f.ranges) == 1 {
+		return f.copyRange(rw, f.ranges[0])
+	}
+
+	mw := multipart.NewWriter(rw)
+	mw.SetBoundary(f.boundary)
+	for _, ra := range f.ranges {
+		part, err := mw.CreatePart(ra.mimeHeader(f.contentType, f.size))
+		if err != nil {
+			return err
+		}
+		if err := f.copyRange(part, ra); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+func (f *fileContent) copyRange(w io.Writer, ra byteRange) error {
+	if _, err := f.content.Seek(ra.Start, io.SeekStart); err != nil {
+		return err
+	}
+	// io.CopyN wraps the content in an io.LimitedReader, which the http
+	// package knows how to sendfile when the content is an *os.File.
+	_, err := io.CopyN(w, f.content, ra.Length)
+	return err
+}
+
+func (f *fileContent) close() {
+	closeContent(f.content)
+}
+
+// Computes the exact size of a multipart/byteranges body without reading any
+// content, so that we can send Content-Length.
+func (f *fileContent) multipartLength() int64 {
+	var w countingWriter
+	mw := multipart.NewWriter(&w)
+	mw.SetBoundary(f.boundary)
+	for _, ra := range f.ranges {
+		mw.CreatePart(ra.mimeHeader(f.contentType, f.size))
+		w += countingWriter(ra.Length)
+	}
+	mw.Close()
+	return int64(w)
+}
+
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+func closeContent(content io.ReadSeeker) {
+	if closer, ok := content.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// Evaluates conditional request headers in the order given by RFC 9110 section
+// 13.2.2. Returns 0 if the request should proceed, or the status code to
+// respond with instead (304 or 412).
+func checkPreconditions(req *http.Request, etag string, modtime time.Time) int {
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != "" {
+		if !etagListMatches(ifMatch, etag, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if t, err := http.ParseTime(req.Header.Get("If-Unmodified-Since")); err == nil && !isZeroTime(modtime) {
+		if modtime.Truncate(time.Second).After(t) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	isGetOrHead := req.Method == http.MethodGet || req.Method == http.MethodHead
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if etagListMatches(ifNoneMatch, etag, true) {
+			if isGetOrHead {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if t, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil && isGetOrHead && !isZeroTime(modtime) {
+		if !modtime.Truncate(time.Second).After(t) {
+			return http.StatusNotModified
+		}
+	}
+
+	return 0
+}
+
+// Reports whether a Range header should be honored according to If-Range.
+// If-Range requires a strong validator: a strong ETag, or a date that exactly
+// matches the modification time.
+func ifRangeMatches(req *http.Request, etag string, modtime time.Time) bool {
+	ifRange := req.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return etagListMatches(ifRange, etag, false)
+	}
+	t, err := http.ParseTime(ifRange)
+	if err != nil || isZeroTime(modtime) {
+		return false
+	}
+	return modtime.Truncate(time.Second).Equal(t)
+}
+
+// Checks an If-Match or If-None-Match header value against an entity tag. If
+// weak is false, the strong comparison function is used, in which weak tags
+// never match.
+func etagListMatches(list string, etag string, weak bool) bool {
+	list = strings.TrimSpace(list)
+	if list == "*" {
+		return true
+	}
+	if etag == "" {
+		return false
+	}
+
+	for list != "" {
+		list = strings.TrimLeft(list, " \t,")
+		candidate, rest, ok := scanETag(list)
+		if !ok {
+			return false
+		}
+		list = rest
+
+		if weak {
+			if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		} else {
+			if !strings.HasPrefix(candidate, "W/") && !strings.HasPrefix(etag, "W/") && candidate == etag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Reads one entity tag from the start of s, returning the tag (including any
+// W/ prefix and quotes) and the remainder of the string.
+func scanETag(s string) (etag string, rest string, ok bool) {
+	start := 0
+	if strings.HasPrefix(s, "W/") {
+		start = 2
+	}
+	if len(s) <= start || s[start] != '"' {
+		return "", s, false
+	}
+	end := strings.IndexByte(s[start+1:], '"')
+	if end < 0 {
+		return "", s, false
+	}
+	end += start + 2
+	return s[:end], s[end:], true
+}
+
+var errRangeUnsatisfiable = errors.New("requested range not satisfiable")
+var errRangeInvalid = errors.New("invalid range")
+
+// Parses a Range header such as "bytes=0-99,200-". Ranges that fall entirely
+// outside the content are dropped; if none remain, errRangeUnsatisfiable is
+// returned.
+func parseRange(s string, size int64) ([]byteRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(s, prefix) {
+		return nil, errRangeInvalid
+	}
+
+	var ranges []byteRange
+	noOverlap := false
+	for _, spec := range strings.Split(s[len(prefix):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		startStr, endStr, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, errRangeInvalid
+		}
+		startStr, endStr = strings.TrimSpace(startStr), strings.TrimSpace(endStr)
+
+		var ra byteRange
+		if startStr == "" {
+			// Suffix range: the last N bytes
+			n, err := strconv.ParseInt(endStr, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errRangeInvalid
+			}
+			if n == 0 {
+				noOverlap = true
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			ra.Start = size - n
+			ra.Length = n
+		} else {
+			start, err := strconv.ParseInt(startStr, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errRangeInvalid
+			}
+			if start >= size {
+				noOverlap = true
+				continue
+			}
+			ra.Start = start
+			if endStr == "" {
+				ra.Length = size - start
+			} else {
+				end, err := strconv.ParseInt(endStr, 10, 64)
+				if err != nil || end < start {
+					return nil, errRangeInvalid
+				}
+				if end >= size {
+					end = size - 1
+				}
+				ra.Length = end - start + 1
+			}
+		}
+		ranges = append(ranges, ra)
+	}
+
+	if len(ranges) == 0 {
+		if noOverlap {
+			return nil, errRangeUnsatisfiable
+		}
+		return nil, errRangeInvalid
+	}
+	return ranges, nil
+}
+
+var unixEpoch = time.Unix(0, 0)
+
+func isZeroTime(t time.Time) bool {
+	return t.IsZero() || t.Equal(unixEpoch)
+}
@@ -0,0 +1,121 @@
+package website
+
+import (
+	"hsf/src/logging"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRange(t *testing.T) {
+	ranges, err := parseRange("bytes=0-4,10-,-3", 20)
+	assert.NoError(t, err)
+	assert.Equal(t, []byteRange{{0, 5}, {10, 10}, {17, 3}}, ranges)
+
+	ranges, err = parseRange("bytes=5-100", 20)
+	assert.NoError(t, err)
+	assert.Equal(t, []byteRange{{5, 15}}, ranges)
+
+	_, err = parseRange("bytes=30-40", 20)
+	assert.ErrorIs(t, err, errRangeUnsatisfiable)
+
+	for _, invalid := range []string{"items=0-5", "bytes=5-1", "bytes=abc", "bytes=-x"} {
+		_, err = parseRange(invalid, 20)
+		assert.ErrorIs(t, err, errRangeInvalid, invalid)
+	}
+}
+
+func TestServeContent(t *testing.T) {
+	const content = "0123456789abcdefghij"
+	modtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	serve := func(method string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/public/talk.txt", nil)
+		for name, val := range headers {
+			req.Header.Set(name, val)
+		}
+		rec := httptest.NewRecorder()
+		c := &RequestContext{Logger: logging.GlobalLogger(), Req: req, Res: rec}
+		doRequest(rec, c, func(c *RequestContext) ResponseData {
+			return c.ServeContent("talk.txt", modtime, strings.NewReader(content), ContentOptions{
+				ETag:           `"v1"`,
+				AttachmentName: "talk.txt",
+			})
+		})
+		return rec
+	}
+
+	t.Run("full", func(t *testing.T) {
+		rec := serve(http.MethodGet, nil)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, content, rec.Body.String())
+		assert.Equal(t, "bytes", rec.Header().Get("Accept-Ranges"))
+		assert.Equal(t, `attachment; filename=talk.txt`, rec.Header().Get("Content-Disposition"))
+	})
+	t.Run("head", func(t *testing.T) {
+		rec := serve(http.MethodHead, nil)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "20", rec.Header().Get("Content-Length"))
+		assert.Empty(t, rec.Body.String())
+	})
+	t.Run("single range", func(t *testing.T) {
+		rec := serve(http.MethodGet, map[string]string{"Range": "bytes=10-14"})
+		assert.Equal(t, http.StatusPartialContent, rec.Code)
+		assert.Equal(t, "abcde", rec.Body.String())
+		assert.Equal(t, "bytes 10-14/20", rec.Header().Get("Content-Range"))
+	})
+	t.Run("multiple ranges", func(t *testing.T) {
+		rec := serve(http.MethodGet, map[string]string{"Range": "bytes=0-1,-2"})
+		assert.Equal(t, http.StatusPartialContent, rec.Code)
+		assert.Equal(t, rec.Header().Get("Content-Length"), strconv.Itoa(rec.Body.Len()))
+
+		mediaType, params, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+		require.NoError(t, err)
+		assert.Equal(t, "multipart/byteranges", mediaType)
+
+		mr := multipart.NewReader(rec.Body, params["boundary"])
+		var parts []string
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			body, _ := io.ReadAll(part)
+			parts = append(parts, part.Header.Get("Content-Range")+" "+string(body))
+		}
+		assert.Equal(t, []string{"bytes 0-1/20 01", "bytes 18-19/20 ij"}, parts)
+	})
+	t.Run("unsatisfiable range", func(t *testing.T) {
+		rec := serve(http.MethodGet, map[string]string{"Range": "bytes=50-"})
+		assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, rec.Code)
+		assert.Equal(t, "bytes */20", rec.Header().Get("Content-Range"))
+	})
+	t.Run("stale If-Range", func(t *testing.T) {
+		rec := serve(http.MethodGet, map[string]string{"Range": "bytes=0-1", "If-Range": `"v0"`})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, content, rec.Body.String())
+	})
+	t.Run("If-None-Match", func(t *testing.T) {
+		rec := serve(http.MethodGet, map[string]string{"If-None-Match": `W/"v1"`})
+		assert.Equal(t, http.StatusNotModified, rec.Code)
+		assert.Empty(t, rec.Body.String())
+	})
+	t.Run("If-Modified-Since", func(t *testing.T) {
+		rec := serve(http.MethodGet, map[string]string{"If-Modified-Since": modtime.Format(http.TimeFormat)})
+		assert.Equal(t, http.StatusNotModified, rec.Code)
+	})
+	t.Run("If-Match", func(t *testing.T) {
+		rec := serve(http.MethodGet, map[string]string{"If-Match": `"v2", W/"v1"`})
+		assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	})
+}
@@ -0,0 +1,149 @@
+package website
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+/*
+ * Flash messages are short notices that survive exactly one redirect, e.g.
+ * "Thanks, you're subscribed!" after a POST-redirect-GET. They are stored in a
+ * cookie on the response that performs the redirect, and cleared by the first
+ * request that reads them.
+ *
+ * The cookie is not signed. A flash message is only ever shown to the person
+ * whose browser holds the cookie, and it is escaped like any other template
+ * data, so there is nothing to gain by forging one. Do not put anything in a
+ * flash message that you would not be happy for the user to edit.
+ */
+
+type FlashKind string
+
+const (
+	FlashSuccess FlashKind = "success"
+	FlashWarn    FlashKind = "warn"
+	FlashFailure FlashKind = "failure"
+)
+
+type Flash struct {
+	Kind    FlashKind `json:"k"`
+	Message string    `json:"m"`
+}
+
+const FlashCookieName = "hsf_flash"
+
+// Browsers reject cookies larger than about 4KB. We stay well under that and
+// drop old messages if a handler gets carried away.
+const maxFlashCookieLen = 2048
+
+// Adds a flash message to be displayed on the next page the user visits.
+// Typically used together with a redirect:
+//
+//	res := c.RedirectAfterPost("/")
+//	res.AddFlash(FlashSuccess, "Thanks, you're subscribed!")
+//	return res
+func (rd *ResponseData) AddFlash(kind FlashKind, message string) {
+	rd.flashes = append(rd.flashes, Flash{Kind: kind, Message: message})
+
+	var encoded string
+	for {
+		flashJson, err := json.Marshal(rd.flashes)
+		if err != nil {
+			panic(err) // a slice of strings always marshals
+		}
+		encoded = base64.RawURLEncoding.EncodeToString(flashJson)
+		if len(encoded) <= maxFlashCookieLen || len(rd.flashes) == 1 {
+			break
+		}
+		rd.flashes = rd.flashes[1:]
+	}
+
+	rd.setFlashCookie(&http.Cookie{
+		Name:     FlashCookieName,
+		Value:    encoded,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Returns any flash messages sent to this request, and arranges for them to
+// be cleared from the user's browser once the response is sent. Called by
+// GetBaseData, so handlers should rarely need to call this directly.
+func (c *RequestContext) Flashes() []Flash {
+	if c.flashesRead {
+		return c.flashes
+	}
+	c.flashesRead = true
+
+	cookie, err := c.Req.Cookie(FlashCookieName)
+	if err != nil {
+		return nil
+	}
+
+	c.flashes, err = decodeFlashes(cookie.Value)
+	if err != nil {
+		c.Logger.Debug().Err(err).Msg("Ignoring malformed flash cookie")
+		return nil
+	}
+
+	return c.flashes
+}
+
+func decodeFlashes(value string) ([]Flash, error) {
+	flashJson, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	var flashes []Flash
+	if err := json.Unmarshal(flashJson, &flashes); err != nil {
+		return nil, err
+	}
+	return flashes, nil
+}
+
+func (rd *ResponseData) setFlashCookie(cookie *http.Cookie) {
+	// Only ever send one flash cookie, or the browser may keep the wrong one.
+	var others []string
+	for _, existing := range rd.Header().Values("Set-Cookie") {
+		if strings.HasPrefix(existing, FlashCookieName+"=") {
+			continue
+		}
+		others = append(others, existing)
+	}
+	rd.Header().Del("Set-Cookie")
+	for _, other := range others {
+		rd.Header().Add("Set-Cookie", other)
+	}
+	rd.SetCookie(cookie)
+}
+
+// Clears flash messages that were displayed during this request, unless the
+// handler queued up new ones of its own. A malformed flash cookie is cleared
+// whether or not anything tried to read it, since it will never be readable.
+func MiddlewareFlash(h Handler) Handler {
+	return func(c *RequestContext) ResponseData {
+		res := h(c)
+
+		if len(res.flashes) > 0 {
+			return res
+		}
+		cookie, err := c.Req.Cookie(FlashCookieName)
+		if err != nil {
+			return res
+		}
+		if _, err := decodeFlashes(cookie.Value); c.flashesRead || err != nil {
+			res.setFlashCookie(&http.Cookie{
+				Name:     FlashCookieName,
+				Path:     "/",
+				MaxAge:   -1,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+
+		return res
+	}
+}
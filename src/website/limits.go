@@ -0,0 +1,250 @@
+package website
+
+import (
+	"context"
+	"errors"
+	"hsf/src/ee"
+	"hsf/src/logging"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Middleware for limiting how long a handler may run and how large a request
+ * body it may read. WebsiteRoutes applies the defaults from config.Config to
+ * every route; route groups can apply tighter limits on top. Limits only ever
+ * get tighter when nested, so routes that need more generous limits (e.g.
+ * file uploads) should be registered on a RouteBuilder that does not include
+ * the defaults.
+ */
+
+// Gives the handler a deadline. The RequestContext (which is a
+// context.Context) is canceled when the deadline passes, and handlers that
+// respect it can stop early. Handlers that don't are abandoned: the user gets
+// a 503 page straight away, anything the handler writes to c.Res from then on
+// is discarded, and so is its eventual response.
+//
+// The timeout only covers running the handler. Sending the response, e.g. a
+// large file from ServeFile, is not limited. Don't use this on routes that
+// hijack the connection or proxy it elsewhere.
+func MiddlewareTimeout(timeout time.Duration) Middleware {
+	return func(h Handler) Handler {
+		return func(c *RequestContext) ResponseData {
+			originalCtx := c.ctx
+			originalRes := c.Res
+			timeoutCtx, cancel := context.WithTimeout(originalCtx, timeout)
+			defer cancel()
+
+			// If we time out, the handler keeps running in the background, so it
+			// gets its own copy of the RequestContext to avoid racing with us.
+			tw := &timeoutWriter{w: c.Res, header: make(http.Header)}
+			handlerContext := *c
+			handlerContext.ctx = timeoutCtx
+			handlerContext.Res = tw
+
+			done := make(chan ResponseData, 1)
+			panicked := make(chan any, 1)
+			go func() {
+				defer func() {
+					if recovered := recover(); recovered != nil {
+						if recovered == http.ErrAbortHandler {
+							panicked <- recovered
+						} else {
+							// Capture the stack now, while it still points at the
+							// handler.
+							panicked <- handlerPanic{value: recovered, stack: ee.Trace()}
+						}
+					}
+				}()
+				done <- h(&handlerContext)
+			}()
+
+			select {
+			case res := <-done:
+				tw.finish()
+				*c = handlerContext
+				c.ctx = originalCtx
+				c.Res = originalRes
+				return res
+			case recovered := <-panicked:
+				tw.finish()
+				*c = handlerContext
+				c.ctx = originalCtx
+				c.Res = originalRes
+				panic(recovered)
+			case <-timeoutCtx.Done():
+				wroteHeader := tw.timeOut()
+				logger := c.Logger
+				go func() {
+					// Clean up after the handler whenever it does finish.
+					select {
+					case res := <-done:
+						if res.file != nil {
+							res.file.close()
+						}
+					case recovered := <-panicked:
+						if recovered != http.ErrAbortHandler {
+							logging.LogPanicValue(logger, panicError(recovered), "request panicked after timing out")
+						}
+					}
+				}()
+
+				if originalCtx.Err() != nil {
+					// Not our timeout; the client went away or the server is
+					// shutting down. Nobody will see the response anyway.
+					c.Logger.Debug().Str("Url", c.Req.URL.Path).Msg("Request canceled")
+				} else {
+					c.Logger.Warn().
+						Str("Url", c.Req.URL.Path).
+						Dur("Timeout", timeout).
+						Msg("Request timed out")
+				}
+				if wroteHeader {
+					// Too late for an error page; the client gets a truncated
+					// response.
+					return ResponseData{Proxied: true}
+				}
+				return render503HTML(c)
+			}
+		}
+	}
+}
+
+// The ResponseWriter given to handlers under MiddlewareTimeout. It stops
+// passing writes through once the timeout fires, so that an abandoned handler
+// can't interfere with the error page. Headers are kept separately until the
+// handler writes, for the same reason.
+type timeoutWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(statusCode int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if !tw.timedOut {
+		tw.writeHeaderLocked(statusCode)
+	}
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.writeHeaderLocked(http.StatusOK)
+	return tw.w.Write(p)
+}
+
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	tw.writeHeaderLocked(http.StatusOK)
+	if flusher, ok := tw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Lets http.ResponseController reach the underlying writer, e.g. to set
+// deadlines.
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.w
+}
+
+func (tw *timeoutWriter) writeHeaderLocked(statusCode int) {
+	if tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+	tw.copyHeader()
+	tw.w.WriteHeader(statusCode)
+}
+
+func (tw *timeoutWriter) copyHeader() {
+	for name, vals := range tw.header {
+		tw.w.Header()[name] = vals
+	}
+}
+
+// Called once the handler has returned. Headers it set without writing are
+// passed on, as they would be without the timeout.
+func (tw *timeoutWriter) finish() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if !tw.wroteHeader {
+		tw.copyHeader()
+	}
+}
+
+// Stops any further writes, and reports whether the handler had already
+// started the response.
+func (tw *timeoutWriter) timeOut() bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.timedOut = true
+	return tw.wroteHeader
+}
+
+// Limits the size of the request body. Requests that declare a larger
+// Content-Length are rejected immediately; otherwise, reads past the limit
+// fail with *http.MaxBytesError, and whatever the handler returns is replaced
+// with a 413 page.
+func MiddlewareMaxBodySize(maxBytes int64) Middleware {
+	return func(h Handler) Handler {
+		return func(c *RequestContext) ResponseData {
+			if c.Req.ContentLength > maxBytes {
+				return render413HTML(c)
+			}
+			if c.Req.Body == nil {
+				return h(c)
+			}
+
+			body := &limitedBody{
+				ReadCloser: http.MaxBytesReader(c.Res, c.Req.Body, maxBytes),
+			}
+			c.Req.Body = body
+
+			res := h(c)
+			if body.exceeded.Load() && !res.Proxied {
+				c.Logger.Warn().
+					Str("Url", c.Req.URL.Path).
+					Int64("Limit", maxBytes).
+					Msg("Request body too large")
+				return render413HTML(c)
+			}
+
+			return res
+		}
+	}
+}
+
+// Remembers whether the body limit was hit, so that we can show a friendly
+// page no matter how the handler reports the error.
+type limitedBody struct {
+	io.ReadCloser
+	exceeded atomic.Bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		b.exceeded.Store(true)
+	}
+	return n, err
+}
@@ -0,0 +1,122 @@
+package website
+
+import (
+	"context"
+	"hsf/src/ee"
+	"hsf/src/logging"
+	"hsf/src/templates"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestContext(method string, body io.Reader) *RequestContext {
+	req := httptest.NewRequest(method, "/", body)
+	return &RequestContext{
+		Logger: logging.GlobalLogger(),
+		Req:    req,
+		Res:    httptest.NewRecorder(),
+		ctx:    req.Context(),
+	}
+}
+
+func TestMiddlewareTimeout(t *testing.T) {
+	templates.LoadEmbedded()
+
+	t.Run("fast handler", func(t *testing.T) {
+		c := newTestContext(http.MethodGet, nil)
+		res := MiddlewareTimeout(time.Second)(func(c *RequestContext) ResponseData {
+			_, hasDeadline := c.Deadline()
+			assert.True(t, hasDeadline)
+			c.currentTemplate = "landing"
+			return ResponseData{StatusCode: http.StatusNoContent}
+		})(c)
+		assert.Equal(t, http.StatusNoContent, res.StatusCode)
+		assert.Equal(t, "landing", c.currentTemplate)
+		assert.NoError(t, c.Err())
+	})
+	t.Run("slow handler", func(t *testing.T) {
+		c := newTestContext(http.MethodGet, nil)
+		canceled := make(chan error, 1)
+		before := time.Now()
+		res := MiddlewareTimeout(50 * time.Millisecond)(func(c *RequestContext) ResponseData {
+			<-c.Done()
+			canceled <- c.Err()
+			time.Sleep(time.Second)
+			return ResponseData{StatusCode: http.StatusNoContent}
+		})(c)
+		assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+		assert.Less(t, time.Since(before), 500*time.Millisecond)
+		assert.ErrorIs(t, <-canceled, context.DeadlineExceeded)
+	})
+	t.Run("writes after timeout", func(t *testing.T) {
+		c := newTestContext(http.MethodGet, nil)
+		rec := c.Res.(*httptest.ResponseRecorder)
+		writeErr := make(chan error, 1)
+		res := MiddlewareTimeout(50 * time.Millisecond)(func(c *RequestContext) ResponseData {
+			<-c.Done()
+			time.Sleep(50 * time.Millisecond)
+			c.Res.Header().Set("X-Late", "yes")
+			_, err := c.Res.Write([]byte("too late"))
+			writeErr <- err
+			return ResponseData{Proxied: true}
+		})(c)
+		assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+		assert.ErrorIs(t, <-writeErr, http.ErrHandlerTimeout)
+		assert.False(t, rec.Flushed)
+		assert.Empty(t, rec.Body.String())
+		assert.Empty(t, rec.Header().Get("X-Late"))
+	})
+	t.Run("panicking handler", func(t *testing.T) {
+		panicking := MiddlewareTimeout(time.Second)(func(c *RequestContext) ResponseData {
+			panic("oh no")
+		})
+
+		res := MiddlewareRecoverPanics(panicking)(newTestContext(http.MethodGet, nil))
+		assert.Equal(t, http.StatusInternalServerError, res.StatusCode)
+
+		// The panic is only wrapped once, and keeps the handler's stack.
+		var recovered any
+		func() {
+			defer func() { recovered = recover() }()
+			panicking(newTestContext(http.MethodGet, nil))
+		}()
+		err := panicError(recovered)
+		assert.EqualError(t, err, "panic: oh no")
+		assert.NotEmpty(t, err.(*ee.Error).Stack)
+	})
+}
+
+func TestMiddlewareMaxBodySize(t *testing.T) {
+	templates.LoadEmbedded()
+
+	readBody := func(c *RequestContext) ResponseData {
+		_, err := io.ReadAll(c.Req.Body)
+		if err != nil {
+			return ResponseData{StatusCode: http.StatusBadRequest}
+		}
+		return ResponseData{StatusCode: http.StatusNoContent}
+	}
+
+	t.Run("small body", func(t *testing.T) {
+		c := newTestContext(http.MethodPost, strings.NewReader("hello"))
+		res := MiddlewareMaxBodySize(10)(readBody)(c)
+		assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	})
+	t.Run("declared large body", func(t *testing.T) {
+		c := newTestContext(http.MethodPost, strings.NewReader("hello world"))
+		res := MiddlewareMaxBodySize(10)(readBody)(c)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+	})
+	t.Run("streamed large body", func(t *testing.T) {
+		c := newTestContext(http.MethodPost, io.MultiReader(strings.NewReader("hello world")))
+		c.Req.ContentLength = -1
+		res := MiddlewareMaxBodySize(10)(readBody)(c)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+	})
+}
@@ -0,0 +1,196 @@
+package website
+
+import (
+	"errors"
+	"hsf/src/ee"
+	"hsf/src/logging"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Normally the website opens its own listening sockets. It can also inherit
+ * them from another process, which lets us restart without refusing or
+ * dropping any connections:
+ *
+ * - On SIGUSR2, the running server starts a fresh copy of its own
+ *   executable (which you may have just rebuilt), passing down its listening
+ *   sockets. Once the new process reports that it is serving, the old one
+ *   shuts down gracefully, finishing in-flight requests, long-running
+ *   requests, and background jobs as usual. Both processes share the same
+ *   sockets in the meantime, so new connections are simply accepted by
+ *   whichever process gets to them first. If the new process fails to start,
+ *   the old one keeps serving. (SIGHUP does not restart the server; it
+ *   reopens log files for logrotate. See config.LogFileConfig.)
+ *
+ * - Under systemd socket activation, systemd opens the sockets and passes
+ *   them in via LISTEN_FDS. Set FileDescriptorName= in the .socket unit to
+ *   the listener names used in Start (e.g. "website"). A single socket with
+ *   no matching name is used for the website.
+ *
+ * Note that a re-exec'd process has a new PID, so under systemd you will want
+ * socket activation and a plain `systemctl restart` rather than SIGUSR2. In
+ * Dev, the esbuild server's port is not handed down, so the new process will
+ * fail to start it.
+ */
+
+const (
+	listenFdsEnv     = "HSF_LISTEN_FDS"
+	listenFdNamesEnv = "HSF_LISTEN_FDNAMES"
+	readyFdEnv       = "HSF_READY_FD"
+
+	// Inherited file descriptors start after stdin, stdout, and stderr. This
+	// matches both systemd (SD_LISTEN_FDS_START) and exec.Cmd.ExtraFiles.
+	firstInheritedFd = 3
+)
+
+type namedListener struct {
+	Name     string
+	Listener net.Listener
+}
+
+var inheritedListeners map[string]net.Listener
+var inheritedListenersOnce sync.Once
+
+// Addresses starting with this prefix are Unix socket paths, e.g.
+// "unix:/run/hsf/website.sock".
+const unixAddrPrefix = "unix:"
+
+// Returns a listener for the given address, reusing one passed down by a
+// parent process or systemd under the given name if there is one. Unix
+// sockets are created with the given permissions.
+func listen(name string, addr string, socketMode os.FileMode) (net.Listener, error) {
+	inheritedListenersOnce.Do(loadInheritedListeners)
+
+	if l, ok := inheritedListeners[name]; ok {
+		delete(inheritedListeners, name)
+		logging.Info().Str("Name", name).Str("Address", l.Addr().String()).Msg("Using inherited listener")
+		return l, nil
+	}
+
+	if path, isUnix := strings.CutPrefix(addr, unixAddrPrefix); isUnix {
+		return listenUnix(path, socketMode)
+	}
+	return net.Listen("tcp", addr)
+}
+
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, ee.New(err, "failed to set permissions on socket %s", path)
+	}
+
+	return l, nil
+}
+
+// A socket file left behind by a process that crashed (or was killed) would
+// make Listen fail, so we remove it, but only if nobody is listening on it.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return ee.New(err, "failed to check for existing socket %s", path)
+	}
+
+	if info.Mode().Type() != os.ModeSocket {
+		return ee.New(nil, "%s already exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return ee.New(nil, "socket %s is already in use by another process", path)
+	}
+
+	logging.Info().Str("Path", path).Msg("Removing stale socket")
+	if err := os.Remove(path); err != nil {
+		return ee.New(err, "failed to remove stale socket %s", path)
+	}
+	return nil
+}
+
+func loadInheritedListeners() {
+	inheritedListeners = make(map[string]net.Listener)
+
+	countStr, namesStr := os.Getenv(listenFdsEnv), os.Getenv(listenFdNamesEnv)
+	fromSystemd := false
+	if countStr == "" && os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) {
+		countStr, namesStr = os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+		fromSystemd = true
+	}
+
+	// Don't pass these on to any child processes by accident
+	for _, env := range []string{listenFdsEnv, listenFdNamesEnv, "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(env)
+	}
+
+	if countStr == "" {
+		return
+	}
+	count, err := strconv.Atoi(countStr)
+	if err != nil {
+		logging.Error().Err(err).Str("Count", countStr).Msg("Invalid count of inherited listeners")
+		return
+	}
+
+	names := strings.Split(namesStr, ":")
+	for i := 0; i < count; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		if fromSystemd && count == 1 && name != "website" {
+			// systemd names sockets after the unit by default
+			name = "website"
+		}
+
+		f := os.NewFile(uintptr(firstInheritedFd+i), name)
+		l, err := net.FileListener(f)
+		f.Close() // FileListener makes its own copy
+		if err != nil {
+			logging.Error().Err(err).Str("Name", name).Msg("Failed to use inherited listener")
+			continue
+		}
+		if ul, ok := l.(*net.UnixListener); ok && !fromSystemd {
+			// We are now responsible for cleaning up the socket file, unless we
+			// hand it off again. (systemd manages its own socket files.)
+			ul.SetUnlinkOnClose(true)
+		}
+		inheritedListeners[name] = l
+	}
+}
+
+// Tells the parent process, if any, that we are serving requests and that it
+// can shut down.
+func notifyReady() {
+	fdStr := os.Getenv(readyFdEnv)
+	if fdStr == "" {
+		return
+	}
+	os.Unsetenv(readyFdEnv)
+
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		logging.Error().Err(err).Msg("Invalid ready file descriptor from parent process")
+		return
+	}
+
+	f := os.NewFile(uintptr(fd), "ready")
+	defer f.Close()
+	if _, err := f.Write([]byte{1}); err != nil {
+		logging.Error().Err(err).Msg("Failed to notify parent process that we are ready")
+	}
+}
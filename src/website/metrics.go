@@ -0,0 +1,119 @@
+package website
+
+import (
+	"hsf/src/jobs"
+	"hsf/src/metrics"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var requestDuration = metrics.Register(metrics.NewHistogramVec(
+	"hsf_http_request_duration_seconds",
+	"Time taken to handle requests, by route pattern, method, and status code.",
+	metrics.DefaultBuckets,
+	"route", "method", "status",
+))
+var requestsInFlight = metrics.Register(metrics.NewGaugeVec(
+	"hsf_http_requests_in_flight",
+	"Requests currently being handled.",
+)).With()
+
+// Records request counts and durations. Responses from proxied and hijacked
+// routes are counted with status "proxied", since we don't know what was
+// actually sent.
+func MiddlewareMetrics(h Handler) Handler {
+	return func(c *RequestContext) ResponseData {
+		requestsInFlight.Inc()
+		defer requestsInFlight.Dec()
+
+		res := h(c)
+
+		status := "proxied"
+		if !res.Proxied {
+			code := res.StatusCode
+			if code == 0 {
+				code = 200
+			}
+			status = strconv.Itoa(code)
+		}
+		requestDuration.
+			With(c.routePattern, methodLabel(c.Req.Method), status).
+			Observe(time.Since(c.RequestStartTime).Seconds())
+
+		return res
+	}
+}
+
+// Clients can send any method they like, so anything unusual is lumped
+// together rather than creating a new series for each.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	default:
+		return "other"
+	}
+}
+
+// Registers metrics that are read from the running server's state at scrape
+// time.
+func registerServerMetrics(status *serverStatus) {
+	metrics.Register(metrics.NewGaugeFunc(
+		"hsf_long_running_requests",
+		"Long-running requests (e.g. websockets) currently open.",
+		func() float64 { return float64(status.LongRunningRequests.Running()) },
+	))
+	metrics.Register(metrics.NewGaugeFunc(
+		"hsf_http_open_connections",
+		"Open connections to the website.",
+		func() float64 { return float64(status.Conns.Open()) },
+	))
+	metrics.Register(metrics.NewGaugeFunc(
+		"hsf_shutting_down",
+		"1 if the server is shutting down, 0 otherwise.",
+		func() float64 {
+			if status.ShuttingDown.Load() {
+				return 1
+			}
+			return 0
+		},
+	))
+	metrics.Register(metrics.CollectorFunc(func() []metrics.Family {
+		// One series per job and state, set to 1 for the job's current state,
+		// plus restart counts
+		f := metrics.Family{
+			Name: "hsf_job_state",
+			Help: "Current state of each background job.",
+			Type: metrics.TypeGauge,
+		}
+		for _, job := range status.Jobs {
+			current := job.State()
+			for _, state := range jobs.States {
+				value := 0.0
+				if state == current {
+					value = 1
+				}
+				f.Samples = append(f.Samples, metrics.Sample{
+					LabelNames:  []string{"job", "state"},
+					LabelValues: []string{job.Name, string(state)},
+					Value:       value,
+				})
+			}
+		}
+		restarts := metrics.Family{
+			Name: "hsf_job_restarts_total",
+			Help: "Times each background job has been restarted after stopping.",
+			Type: metrics.TypeCounter,
+		}
+		for _, job := range status.Jobs {
+			restarts.Samples = append(restarts.Samples, metrics.Sample{
+				LabelNames:  []string{"job"},
+				LabelValues: []string{job.Name},
+				Value:       float64(job.Restarts()),
+			})
+		}
+		return []metrics.Family{f, restarts}
+	}))
+}
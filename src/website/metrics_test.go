@@ -0,0 +1,46 @@
+package website
+
+import (
+	"hsf/src/metrics"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddlewareMetrics(t *testing.T) {
+	handle := func(method string, res ResponseData) {
+		c := newTestContext(method, nil)
+		c.routePattern = "^/metrics-test$"
+		c.RequestStartTime = time.Now()
+		MiddlewareMetrics(func(c *RequestContext) ResponseData {
+			return res
+		})(c)
+	}
+	handle(http.MethodGet, ResponseData{})
+	handle(http.MethodPost, ResponseData{StatusCode: http.StatusCreated})
+	handle("BREW", ResponseData{StatusCode: http.StatusTeapot})
+	handle("MADE-UP", ResponseData{StatusCode: http.StatusTeapot})
+	handle(http.MethodGet, ResponseData{Proxied: true})
+
+	var out strings.Builder
+	require.NoError(t, metrics.WritePrometheus(&out))
+	count := func(method, status string) string {
+		prefix := `hsf_http_request_duration_seconds_count{route="^/metrics-test$",method="` + method + `",status="` + status + `"} `
+		for _, line := range strings.Split(out.String(), "\n") {
+			if strings.HasPrefix(line, prefix) {
+				return strings.TrimPrefix(line, prefix)
+			}
+		}
+		return ""
+	}
+	assert.Equal(t, "1", count("GET", "200"))
+	assert.Equal(t, "1", count("POST", "201"))
+	assert.Equal(t, "2", count("other", "418"))
+	assert.Equal(t, "1", count("GET", "proxied"))
+	assert.NotContains(t, out.String(), "BREW")
+	assert.NotContains(t, out.String(), "MADE-UP")
+}
@@ -0,0 +1,169 @@
+package website
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Some resources are useful both to browsers (as HTML) and to scripts (as
+ * JSON). Rather than making separate routes, a handler can offer several
+ * renderings of the same data and let the Accept header pick:
+ *
+ *   return c.Negotiate(
+ *       OfferHTML("news", data),
+ *       OfferJSON(data),
+ *   )
+ *
+ * Offers are listed in order of preference; the first one wins whenever the
+ * client has no strong opinion (including when there is no Accept header at
+ * all). If the client accepts none of them, the response is 406 Not
+ * Acceptable. Either way, doRequest adds "Vary: Accept" so that caches keep
+ * the renderings apart.
+ */
+
+type Offer struct {
+	ContentType string // e.g. "application/json", without parameters
+	Render      func(c *RequestContext) ResponseData
+}
+
+func OfferHTML(templateName string, templateData any) Offer {
+	return Offer{
+		ContentType: "text/html",
+		Render: func(c *RequestContext) ResponseData {
+			return renderHTML(c, templateName, templateData)
+		},
+	}
+}
+
+func OfferJSON(data any) Offer {
+	return Offer{
+		ContentType: "application/json",
+		Render: func(c *RequestContext) ResponseData {
+			return renderJSON(c, data)
+		},
+	}
+}
+
+func OfferText(text string) Offer {
+	return Offer{
+		ContentType: "text/plain",
+		Render: func(c *RequestContext) ResponseData {
+			return renderText(c, text)
+		},
+	}
+}
+
+// Picks the best of the given offers according to the request's Accept
+// header and renders it.
+func (c *RequestContext) Negotiate(offers ...Offer) ResponseData {
+	c.negotiated = true
+
+	offer, ok := NegotiateContentType(c.Req.Header.Get("Accept"), offers)
+	if !ok {
+		var available []string
+		for _, o := range offers {
+			available = append(available, o.ContentType)
+		}
+
+		res := ResponseData{
+			StatusCode: http.StatusNotAcceptable,
+		}
+		res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		res.Write([]byte("This resource is available as: " + strings.Join(available, ", ") + "\n"))
+		return res
+	}
+
+	return offer.Render(c)
+}
+
+type mediaRange struct {
+	Type, Subtype string
+	Q             float64
+}
+
+// Returns the offer best matching an Accept header. Ties go to whichever
+// offer comes first.
+func NegotiateContentType(accept string, offers []Offer) (Offer, bool) {
+	if len(offers) == 0 {
+		return Offer{}, false
+	}
+	if strings.TrimSpace(accept) == "" {
+		return offers[0], true
+	}
+
+	ranges := parseAccept(accept)
+
+	bestIdx := -1
+	bestQ := 0.0
+	for i, offer := range offers {
+		q := qualityFor(ranges, offer.ContentType)
+		if q > bestQ {
+			bestIdx = i
+			bestQ = q
+		}
+	}
+
+	if bestIdx < 0 {
+		return Offer{}, false
+	}
+	return offers[bestIdx], true
+}
+
+// Parses an Accept header into media ranges, most specific first. Malformed
+// entries are skipped.
+func parseAccept(accept string) []mediaRange {
+	var ranges []mediaRange
+	for _, entry := range strings.Split(accept, ",") {
+		params := strings.Split(entry, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		typ, subtype, ok := strings.Cut(mediaType, "/")
+		if !ok || typ == "" || subtype == "" || (typ == "*" && subtype != "*") {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				parsed = 0
+			}
+			q = parsed
+		}
+
+		ranges = append(ranges, mediaRange{Type: typ, Subtype: subtype, Q: q})
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].specificity() > ranges[j].specificity()
+	})
+
+	return ranges
+}
+
+func (r mediaRange) specificity() int {
+	if r.Type == "*" {
+		return 0
+	} else if r.Subtype == "*" {
+		return 1
+	}
+	return 2
+}
+
+// Returns the q-value the client assigned to contentType, using the most
+// specific matching media range. A result of 0 means not acceptable.
+func qualityFor(ranges []mediaRange, contentType string) float64 {
+	typ, subtype, _ := strings.Cut(strings.ToLower(contentType), "/")
+	for _, r := range ranges {
+		if (r.Type == "*" || r.Type == typ) && (r.Subtype == "*" || r.Subtype == subtype) {
+			return r.Q
+		}
+	}
+	return 0
+}
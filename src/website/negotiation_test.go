@@ -0,0 +1,33 @@
+package website
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateContentType(t *testing.T) {
+	offers := []Offer{
+		{ContentType: "text/html"},
+		{ContentType: "application/json"},
+		{ContentType: "text/plain"},
+	}
+
+	pick := func(accept string) string {
+		offer, ok := NegotiateContentType(accept, offers)
+		if !ok {
+			return ""
+		}
+		return offer.ContentType
+	}
+
+	assert.Equal(t, "text/html", pick(""))
+	assert.Equal(t, "text/html", pick("*/*"))
+	assert.Equal(t, "application/json", pick("application/json"))
+	assert.Equal(t, "application/json", pick("text/html;q=0.5, application/json"))
+	assert.Equal(t, "text/plain", pick("text/*;q=0.5, text/html;q=0.1, application/json;q=0"))
+	assert.Equal(t, "text/html", pick("text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"))
+	assert.Equal(t, "text/plain", pick("TEXT/PLAIN"))
+	assert.Equal(t, "", pick("image/png"))
+	assert.Equal(t, "", pick("*/*;q=0"))
+}
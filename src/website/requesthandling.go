@@ -1,18 +1,25 @@
 package website
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hsf/src/config"
+	"hsf/src/ee"
 	"hsf/src/logging"
 	"io"
+	"net"
 	"net/http"
 	"net/netip"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -60,7 +67,16 @@ import (
 type RequestContext struct {
 	ctx context.Context
 
+	flashes     []Flash
+	flashesRead bool
+	negotiated  bool // Set by Negotiate so doRequest can add Vary: Accept
+	hijacked    bool // Set by Hijack; nothing more can be written to Res
+
+	currentTemplate string // Set by renderHTML for the Dev error page
+	routePattern    string // The matched route's regexes, for metrics and logs
+
 	Logger           *zerolog.Logger
+	RequestID        string // From X-Request-Id if valid, otherwise random
 	Req              *http.Request
 	PathParams       map[string]string
 	RequestStartTime time.Time
@@ -98,16 +114,36 @@ func (c *RequestContext) Value(key any) any {
 
 func (c *RequestContext) IsLongRunning() func() {
 	c.LongRunningRequests.wg.Add(1)
+	c.LongRunningRequests.running.Add(1)
 	doneAlreadyCalled := false
 	return func() {
 		if doneAlreadyCalled {
 			return
 		}
 		doneAlreadyCalled = true
+		c.LongRunningRequests.running.Add(-1)
 		c.LongRunningRequests.wg.Done()
 	}
 }
 
+// Takes over the underlying connection from the http package, e.g. for
+// websockets. A handler that hijacks the connection must return
+// ResponseData{Proxied: true}. Use this instead of calling Hijack on c.Res
+// directly, so that panic recovery knows not to write an error page to a
+// connection it no longer owns.
+func (c *RequestContext) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := c.Res.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response does not support hijacking")
+	}
+
+	conn, bufrw, err := hj.Hijack()
+	if err == nil {
+		c.hijacked = true
+	}
+	return conn, bufrw, err
+}
+
 type ResponseData struct {
 	StatusCode int
 	Body       *bytes.Buffer
@@ -117,7 +153,9 @@ type ResponseData struct {
 	// like esbuild.
 	Proxied bool
 
-	header http.Header
+	header  http.Header
+	flashes []Flash
+	file    *fileContent // Set by ServeContent to stream instead of using Body
 }
 
 var _ http.ResponseWriter = &ResponseData{}
@@ -166,6 +204,17 @@ func (r Route) String() string {
 	return fmt.Sprintf("%s %v", r.Method, routeStrings)
 }
 
+// The route's regexes joined into one string, e.g. "^/public^/.+$" for a route
+// in a group. Unlike URLs, there are only a few of these, so they make good
+// labels for metrics.
+func (r Route) Pattern() string {
+	var b strings.Builder
+	for _, regex := range r.Regexes {
+		b.WriteString(regex.String())
+	}
+	return b.String()
+}
+
 type RouteBuilder struct {
 	Router      *Router
 	Prefixes    []*regexp.Regexp
@@ -288,14 +337,18 @@ nextroute:
 			}
 		}
 
+		requestID := reqRequestID(req)
+		logger := logging.With().Str("RequestID", requestID).Logger()
 		c := &RequestContext{
-			Logger:           logging.GlobalLogger(),
+			Logger:           &logger,
+			RequestID:        requestID,
 			Req:              req,
 			Res:              rw,
 			PathParams:       params,
 			RequestStartTime: time.Now(),
 
-			ctx: req.Context(),
+			ctx:          req.Context(),
+			routePattern: route.Pattern(),
 		}
 
 		doRequest(rw, c, route.Handler)
@@ -308,11 +361,34 @@ nextroute:
 
 func doRequest(rw http.ResponseWriter, c *RequestContext, h Handler) {
 	defer func() {
-		// This panic recovery is the last resort. If you want to render
-		// an error page or something, make it a request wrapper.
+		// This panic recovery is the last resort. Panics in handlers should
+		// be caught by MiddlewareRecoverPanics, which renders the site's error
+		// page; this catches anything else, e.g. panics in outer middleware.
 		if recovered := recover(); recovered != nil {
+			if recovered == http.ErrAbortHandler {
+				// Deliberately aborting the response, e.g. from a reverse proxy.
+				// The http package will close the connection quietly.
+				panic(recovered)
+			}
+
+			panicErr := panicError(recovered)
+			logging.LogPanicValue(c.Logger, panicErr, "request panicked and was not handled")
+			reportError(c, panicErr)
+			if c.hijacked {
+				return
+			}
+
+			if config.Config.Env == config.Dev {
+				devRes, err := renderDevError500HTML(c, panicErr)
+				if err == nil {
+					rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+					rw.WriteHeader(devRes.StatusCode)
+					rw.Write(devRes.Body.Bytes())
+					return
+				}
+			}
+
 			rw.WriteHeader(http.StatusInternalServerError)
-			logging.LogPanicValue(c.Logger, recovered, "request panicked and was not handled")
 			rw.Write([]byte("There was a problem handling your request."))
 		}
 	}()
@@ -350,6 +426,20 @@ func doRequest(rw http.ResponseWriter, c *RequestContext, h Handler) {
 	// Ensure we send no body for HEAD requests
 	if c.Req.Method == http.MethodHead {
 		res.Body = nil
+		if res.file != nil {
+			res.file.close()
+			res.file = nil
+		}
+	}
+
+	// The response depended on the Accept header, so caches must not serve it
+	// to clients asking for something else.
+	if c.negotiated && !headerHasToken(res.Header(), "Vary", "Accept") {
+		res.Header().Add("Vary", "Accept")
+	}
+
+	if c.RequestID != "" {
+		rw.Header().Set("X-Request-Id", c.RequestID)
 	}
 
 	// Send remaining response headers
@@ -364,44 +454,114 @@ func doRequest(rw http.ResponseWriter, c *RequestContext, h Handler) {
 	if res.Body != nil {
 		// Write preamble, if any
 		_, err := rw.Write(preamble)
-		if errors.Is(err, syscall.EPIPE) {
-			// NOTE(asaf): Can be triggered when other side hangs up
-			logging.Debug().Msg("Broken pipe")
-		} else if err != nil {
-			logging.Error().Err(err).Msg("Failed to write response preamble")
-		}
+		logResponseWriteError(err, "Failed to write response preamble")
 
 		// Write remainder of body
 		_, err = io.Copy(rw, res.Body)
-		if errors.Is(err, syscall.EPIPE) {
-			// NOTE(asaf): Can be triggered when other side hangs up
-			logging.Debug().Msg("Broken pipe")
-		} else if err != nil {
-			logging.Error().Err(err).Msg("copied res.Body")
+		logResponseWriteError(err, "copied res.Body")
+	} else if res.file != nil {
+		defer res.file.close()
+		err := res.file.send(rw)
+		logResponseWriteError(err, "Failed to send file content")
+	}
+}
+
+// Reports whether a comma-separated header such as Vary contains token,
+// ignoring case.
+func headerHasToken(header http.Header, name string, token string) bool {
+	for _, val := range header.Values(name) {
+		for _, t := range strings.Split(val, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
 		}
 	}
+	return false
+}
+
+// Converts a value recovered from a panic into an error with a stack trace.
+// Must be called from the deferred function that recovered, so that the
+// stack still includes the code that panicked, unless the value is a
+// handlerPanic carrying its own stack.
+func panicError(recovered any) error {
+	var stack ee.CallStack
+	if p, ok := recovered.(handlerPanic); ok {
+		recovered, stack = p.value, p.stack
+	}
+
+	var err error
+	if recoveredErr, ok := recovered.(error); ok {
+		err = ee.New(recoveredErr, "panic")
+	} else {
+		err = ee.New(nil, "panic: %v", recovered)
+	}
+	if stack != nil {
+		err.(*ee.Error).Stack = stack
+	}
+	return err
+}
+
+// A panic re-raised on a different goroutine from the one that panicked,
+// along with the stack of the original panic.
+type handlerPanic struct {
+	value any
+	stack ee.CallStack
+}
+
+func logResponseWriteError(err error, msg string) {
+	if errors.Is(err, syscall.EPIPE) {
+		// NOTE(asaf): Can be triggered when other side hangs up
+		logging.Debug().Msg("Broken pipe")
+	} else if err != nil {
+		logging.Error().Err(err).Msg(msg)
+	}
 }
 
 // Reverse-proxy-aware full url
 func ReqFullUrl(req *http.Request) string {
+	host := req.Host
+	if host == "" {
+		// Only possible for HTTP/1.0 requests, which in practice means
+		// someone poking at a Unix socket by hand.
+		host = "localhost"
+	}
+	return ReqScheme(req) + "://" + host + req.URL.String()
+}
+
+// Reverse-proxy-aware URL scheme ("http" or "https")
+func ReqScheme(req *http.Request) string {
 	var scheme string
 
 	if scheme == "" {
 		proto, hasProto := req.Header["X-Forwarded-Proto"]
 		if hasProto {
-			scheme = fmt.Sprintf("%s://", proto[0])
+			scheme = proto[0]
 		}
 	}
 
 	if scheme == "" {
 		if req.TLS != nil {
-			scheme = "https://"
+			scheme = "https"
 		} else {
-			scheme = "http://"
+			scheme = "http"
 		}
 	}
 
-	return scheme + req.Host + req.URL.String()
+	return scheme
+}
+
+var requestIDRegex = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+// Uses the request ID from a reverse proxy, if any, so that its logs and ours
+// can be matched up. Otherwise makes a new one.
+func reqRequestID(req *http.Request) string {
+	if id := req.Header.Get("X-Request-Id"); requestIDRegex.MatchString(id) {
+		return id
+	}
+
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
 }
 
 // NOTE(asaf): Assumes port is present (it should be for RemoteAddr according to the docs)
@@ -421,29 +581,32 @@ func ReqGetIP(req *http.Request) *netip.Prefix {
 	if ipString == "" {
 		forwarded, hasForwarded := req.Header["X-Forwarded-For"]
 		if hasForwarded {
-			ipString = forwarded[0]
+			// The client comes first, followed by any proxies along the way
+			client, _, _ := strings.Cut(forwarded[0], ",")
+			ipString = strings.TrimSpace(client)
 		}
 	}
 
 	if ipString == "" {
-		ipString = req.RemoteAddr
-		if ipString != "" {
-			matches := ipRegex.FindStringSubmatch(ipString)
-			if matches != nil {
-				v4 := matches[ipRegex.SubexpIndex("addrv4")]
-				v6 := matches[ipRegex.SubexpIndex("addrv6")]
-				if v4 != "" {
-					ipString = v4
-				} else {
-					ipString = v6
-				}
+		// When listening on a Unix socket, RemoteAddr is a socket path (or "@")
+		// rather than host:port, and there is no IP to report. This is why you
+		// want your reverse proxy to set X-Forwarded-For.
+		matches := ipRegex.FindStringSubmatch(req.RemoteAddr)
+		if matches != nil {
+			v4 := matches[ipRegex.SubexpIndex("addrv4")]
+			v6 := matches[ipRegex.SubexpIndex("addrv6")]
+			if v4 != "" {
+				ipString = v4
+			} else {
+				ipString = v6
 			}
 		}
 	}
 
 	if ipString != "" {
-		res, err := netip.ParsePrefix(fmt.Sprintf("%s/32", ipString))
+		addr, err := netip.ParseAddr(ipString)
 		if err == nil {
+			res := netip.PrefixFrom(addr, addr.BitLen())
 			return &res
 		}
 	}
@@ -455,7 +618,8 @@ type LongRunningRequestTracker struct {
 	ctx    context.Context
 	cancel func()
 
-	wg sync.WaitGroup
+	wg      sync.WaitGroup
+	running atomic.Int64
 }
 
 func NewLongRunningRequestTracker() *LongRunningRequestTracker {
@@ -474,16 +638,26 @@ func (t *LongRunningRequestTracker) Canceled() <-chan struct{} {
 	return t.ctx.Done()
 }
 
-func (t *LongRunningRequestTracker) Wait(timeout time.Duration) {
+// Waits for all long-running requests to finish, or for the timeout to expire.
+// Returns the number of requests still running.
+func (t *LongRunningRequestTracker) Wait(timeout time.Duration) int {
 	done := make(chan struct{})
 	go func() {
 		t.wg.Wait()
-		done <- struct{}{}
+		close(done)
 	}()
 	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 	select {
 	case <-timer.C:
-		logging.Warn().Msg("long-running requests failed to shut down in time")
+		running := t.Running()
+		logging.Warn().Int("Running", running).Msg("long-running requests failed to shut down in time")
+		return running
 	case <-done:
+		return 0
 	}
 }
+
+func (t *LongRunningRequestTracker) Running() int {
+	return int(t.running.Load())
+}
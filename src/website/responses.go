@@ -2,9 +2,15 @@ package website
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
+	"hsf/src/config"
 	"hsf/src/ee"
+	"hsf/src/errreport"
 	"hsf/src/templates"
 	"net/http"
+	"net/url"
+	"strings"
 )
 
 func renderHTML(c *RequestContext, templateName string, templateData any) ResponseData {
@@ -12,6 +18,7 @@ func renderHTML(c *RequestContext, templateName string, templateData any) Respon
 		StatusCode: http.StatusOK,
 	}
 
+	c.currentTemplate = templateName
 	err := templates.Render(&res, templateName, templateData)
 
 	if err != nil {
@@ -21,14 +28,144 @@ func renderHTML(c *RequestContext, templateName string, templateData any) Respon
 	return res
 }
 
+func renderJSON(c *RequestContext, data any) ResponseData {
+	res := ResponseData{
+		StatusCode: http.StatusOK,
+	}
+	res.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	err := json.NewEncoder(&res).Encode(data)
+	if err != nil {
+		return render500HTML(c, ee.New(err, "Failed to encode JSON"))
+	}
+
+	return res
+}
+
+func renderText(c *RequestContext, text string) ResponseData {
+	res := ResponseData{
+		StatusCode: http.StatusOK,
+	}
+	res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	res.Write([]byte(text))
+
+	return res
+}
+
+// Data for the error page templates. Message replaces the page's default
+// text if set, so it must be safe to show to users.
+type errorPageData struct {
+	BaseData
+	Message string
+}
+
+// Default messages for error4xx, by status code.
+var errorMessages = map[int]string{
+	http.StatusBadRequest: "Something about your request wasn't right. Please check it and try again.",
+	http.StatusForbidden:  "You don't have permission to do that.",
+	http.StatusConflict:   "That conflicts with a change made in the meantime. Please reload and try again.",
+}
+
+// Returns the status code to respond with for err, based on its ee.Kind.
+// Errors without a kind are internal server errors.
+func ErrorStatusCode(err error) int {
+	switch ee.KindOf(err) {
+	case ee.KindNotFound:
+		return http.StatusNotFound
+	case ee.KindForbidden:
+		return http.StatusForbidden
+	case ee.KindInvalid:
+		return http.StatusBadRequest
+	case ee.KindConflict:
+		return http.StatusConflict
+	case ee.KindUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Renders the right error page for any error a handler gets back. The user
+// sees only the error's user message (see ee.WithUserMessage) or the page's
+// default text; the error itself, with its context and stack, goes to the
+// logs.
+func renderError(c *RequestContext, err error) ResponseData {
+	status := ErrorStatusCode(err)
+	if status == http.StatusInternalServerError {
+		return render500HTML(c, err)
+	}
+
+	event := c.Logger.Debug()
+	if status == http.StatusServiceUnavailable {
+		event = c.Logger.Warn()
+	}
+	event.Err(err).Fields(ee.ContextOf(err)).Int("Status", status).Msg("Request failed")
+
+	message := ee.UserMessageOf(err)
+	switch status {
+	case http.StatusNotFound:
+		return renderErrorPage(c, status, "error404", message)
+	case http.StatusServiceUnavailable:
+		return renderErrorPage(c, status, "error503", message)
+	default:
+		if message == "" {
+			message = errorMessages[status]
+		}
+		return renderErrorPage(c, status, "error4xx", message)
+	}
+}
+
+func renderErrorPage(c *RequestContext, status int, templateName string, message string) ResponseData {
+	res := ResponseData{
+		StatusCode: status,
+	}
+
+	err := templates.Render(&res, templateName, errorPageData{
+		BaseData: GetBaseData(c),
+		Message:  message,
+	})
+	if err != nil {
+		return render500HTML(c, ee.New(err, "Failed to render %d page", status))
+	}
+
+	return res
+}
+
 func render500HTML(c *RequestContext, error error) ResponseData {
+	c.Logger.Error().Err(error).Fields(ee.ContextOf(error)).Msg("Internal server error")
+	reportError(c, error)
+	return renderUnlogged500HTML(c, error)
+}
+
+// Sends an error to the error reporter (see src/errreport). Only the path is
+// included, since query strings may contain secrets.
+func reportError(c *RequestContext, err error) {
+	errreport.Report(err, map[string]string{
+		"RequestID": c.RequestID,
+		"Method":    c.Req.Method,
+		"Path":      c.Req.URL.Path,
+	})
+}
+
+// Renders the error page without logging the error, for callers that have
+// already logged it in their own way.
+func renderUnlogged500HTML(c *RequestContext, error error) ResponseData {
 	res := ResponseData{
 		StatusCode: http.StatusInternalServerError,
 	}
 
-	c.Logger.Error().Err(error).Msg("Internal server error")
+	if config.Config.Env == config.Dev {
+		devRes, err := renderDevError500HTML(c, error)
+		if err == nil {
+			return devRes
+		}
+		c.Logger.Error().Err(ee.New(err, "Failed to render error500dev template")).Msg("Falling back to the normal error page")
+	}
 
-	err := templates.Render(&res, "error500", GetBaseData())
+	err := templates.Render(&res, "error500", errorPageData{
+		BaseData: GetBaseData(c),
+		Message:  ee.UserMessageOf(error),
+	})
 	if err != nil {
 		c.Logger.Error().Err(ee.New(err, "Failed to render error500 template")).Msg("Failed to render error page")
 
@@ -42,14 +179,75 @@ func render500HTML(c *RequestContext, error error) ResponseData {
 }
 
 func render404HTML(c *RequestContext) ResponseData {
+	return renderErrorPage(c, http.StatusNotFound, "error404", "")
+}
+
+func render413HTML(c *RequestContext) ResponseData {
+	return renderErrorPage(c, http.StatusRequestEntityTooLarge, "error413", "")
+}
+
+func render503HTML(c *RequestContext) ResponseData {
+	return renderErrorPage(c, http.StatusServiceUnavailable, "error503", "")
+}
+
+// Redirects the user to dest with the given status code, which must be one of
+// 301, 302, 303, 307, or 308. Only same-origin destinations are allowed, to
+// prevent open redirects when dest comes from user input (e.g. a ?next=
+// parameter); any other destination redirects to the home page instead.
+func (c *RequestContext) Redirect(dest string, code int) ResponseData {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		panic(fmt.Sprintf("%d is not a redirect status code", code))
+	}
+
+	if !IsSameOriginUrl(c.Req, dest) {
+		c.Logger.Warn().Str("Destination", dest).Msg("Refusing to redirect to another origin")
+		dest = "/"
+	}
+
 	res := ResponseData{
-		StatusCode: http.StatusNotFound,
+		StatusCode: code,
 	}
+	res.Header().Set("Location", dest)
+
+	return res
+}
+
+// Redirects with 303 See Other, which tells the browser to follow up with a
+// GET. Use this at the end of a successful form POST.
+func (c *RequestContext) RedirectAfterPost(dest string) ResponseData {
+	return c.Redirect(dest, http.StatusSeeOther)
+}
 
-	err := templates.Render(&res, "error404", GetBaseData())
+// Reports whether dest, if used as a Location header, would keep the user on
+// the same origin as req. Relative paths are allowed, but protocol-relative
+// URLs (//example.com) and their backslash variants are not, since browsers
+// treat them as absolute. So are URLs with control characters or surrounding
+// whitespace, which browsers (and Go, when writing headers) strip.
+func IsSameOriginUrl(req *http.Request, dest string) bool {
+	if dest == "" || dest != strings.TrimSpace(dest) {
+		return false
+	}
+	for _, r := range dest {
+		if r < 0x20 || r == 0x7f {
+			return false
+		}
+	}
+
+	// Browsers treat backslashes like forward slashes, so "/\example.com" is
+	// really "//example.com".
+	normalized := strings.ReplaceAll(dest, `\`, "/")
+
+	destUrl, err := url.Parse(normalized)
 	if err != nil {
-		return render500HTML(c, ee.New(err, "Failed to render 404 page"))
+		return false
 	}
 
-	return res
+	if destUrl.Scheme == "" && destUrl.Host == "" {
+		return !strings.HasPrefix(normalized, "//")
+	}
+
+	return strings.EqualFold(destUrl.Scheme, ReqScheme(req)) && strings.EqualFold(destUrl.Host, req.Host)
 }
@@ -0,0 +1,118 @@
+package website
+
+import (
+	"hsf/src/config"
+	"hsf/src/ee"
+	"hsf/src/templates"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsSameOriginUrl(t *testing.T) {
+	req := httptest.NewRequest("POST", "http://example.com/subscribe", nil)
+
+	safe := []string{
+		"/",
+		"/news?page=2",
+		"news",
+		"http://example.com/news",
+		"HTTP://EXAMPLE.COM/news",
+	}
+	for _, dest := range safe {
+		assert.True(t, IsSameOriginUrl(req, dest), dest)
+	}
+
+	unsafe := []string{
+		"",
+		"//evil.com",
+		`/\evil.com`,
+		`\\evil.com`,
+		"https://example.com/news",
+		"http://evil.com/",
+		"http://example.com.evil.com/",
+		"http:evil.com",
+		"javascript:alert(1)",
+		"/news\r\nSet-Cookie: a=b",
+		" //evil.com",
+		"\t//evil.com",
+		" /\\evil.com",
+		"//evil.com ",
+		"/news\x00",
+	}
+	for _, dest := range unsafe {
+		assert.False(t, IsSameOriginUrl(req, dest), dest)
+	}
+}
+
+func TestFlashRoundTrip(t *testing.T) {
+	var res ResponseData
+	res.AddFlash(FlashSuccess, "Thanks, you're subscribed!")
+	res.AddFlash(FlashWarn, "Check your email.")
+	assert.Len(t, res.Header().Values("Set-Cookie"), 1)
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Cookie", res.Header().Get("Set-Cookie"))
+	c := &RequestContext{Req: req}
+
+	assert.Equal(t, []Flash{
+		{Kind: FlashSuccess, Message: "Thanks, you're subscribed!"},
+		{Kind: FlashWarn, Message: "Check your email."},
+	}, c.Flashes())
+
+	cleared := MiddlewareFlash(func(c *RequestContext) ResponseData {
+		c.Flashes()
+		return ResponseData{}
+	})(c)
+	assert.Contains(t, cleared.Header().Get("Set-Cookie"), "Max-Age=0")
+}
+
+func TestFlashMalformed(t *testing.T) {
+	c := newTestContext(http.MethodGet, nil)
+	c.Req.AddCookie(&http.Cookie{Name: FlashCookieName, Value: "not%base64"})
+
+	// Cleared even though nothing read it.
+	res := MiddlewareFlash(func(c *RequestContext) ResponseData {
+		return ResponseData{}
+	})(c)
+	assert.Contains(t, res.Header().Get("Set-Cookie"), "Max-Age=0")
+
+	assert.Empty(t, c.Flashes())
+}
+
+func TestRenderError(t *testing.T) {
+	templates.LoadEmbedded()
+
+	render := func(err error) (int, string) {
+		res := renderError(newTestContext(http.MethodGet, nil), err)
+		return res.StatusCode, res.Body.String()
+	}
+
+	status, body := render(ee.WithKind(ee.New(nil, "no post 42 in thread 7"), ee.KindNotFound))
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Contains(t, body, "find the page")
+	assert.NotContains(t, body, "thread 7")
+
+	status, body = render(ee.WithUserMessage(ee.WithKind(ee.New(nil, "user 3 is not an admin"), ee.KindForbidden), "Only admins can do that."))
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Contains(t, body, "Only admins can do that.")
+	assert.NotContains(t, body, "user 3")
+
+	status, body = render(ee.WithKind(ee.New(nil, "bad"), ee.KindConflict))
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Contains(t, body, "Please reload")
+
+	status, _ = render(ee.WithKind(ee.New(nil, "db down"), ee.KindUnavailable))
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+
+	// The detailed error page is only for Dev.
+	defer func(env config.Environment) { config.Config.Env = env }(config.Config.Env)
+	config.Config.Env = config.Live
+	status, body = render(ee.New(nil, "secret internals"))
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.NotContains(t, body, "secret internals")
+
+	assert.Equal(t, http.StatusBadRequest, ErrorStatusCode(ee.WithKind(ee.New(nil, "x"), ee.KindInvalid)))
+}
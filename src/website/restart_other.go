@@ -0,0 +1,21 @@
+//go:build !unix
+
+package website
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+func notifyRestartSignals(c chan<- os.Signal) {
+	// No restart signals on this platform
+}
+
+func notifyReopenLogSignals(c chan<- os.Signal) {
+	// No SIGHUP on this platform
+}
+
+func startReplacementProcess(listeners []namedListener, timeout time.Duration) error {
+	return errors.New("zero-downtime restarts are not supported on this platform")
+}
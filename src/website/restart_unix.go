@@ -0,0 +1,101 @@
+//go:build unix
+
+package website
+
+import (
+	"errors"
+	"fmt"
+	"hsf/src/ee"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func notifyRestartSignals(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
+
+// SIGHUP is the traditional signal for reopening log files, e.g. from a
+// logrotate postrotate script.
+func notifyReopenLogSignals(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGHUP)
+}
+
+// Starts a new copy of this executable with the given listeners, and waits for
+// it to report that it is serving. See listeners.go for the full story.
+func startReplacementProcess(listeners []namedListener, timeout time.Duration) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return ee.New(err, "failed to find own executable")
+	}
+
+	var files []*os.File
+	var names []string
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, nl := range listeners {
+		filer, ok := nl.Listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return ee.New(nil, "listener %s (%T) cannot be passed to another process", nl.Name, nl.Listener)
+		}
+		f, err := filer.File()
+		if err != nil {
+			return ee.New(err, "failed to get file for listener %s", nl.Name)
+		}
+		files = append(files, f)
+		names = append(names, nl.Name)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return ee.New(err, "failed to create ready pipe")
+	}
+	defer readyR.Close()
+	readyFd := firstInheritedFd + len(files)
+	files = append(files, readyW)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%d", listenFdsEnv, len(listeners)),
+		fmt.Sprintf("%s=%s", listenFdNamesEnv, strings.Join(names, ":")),
+		fmt.Sprintf("%s=%d", readyFdEnv, readyFd),
+	)
+	if err := cmd.Start(); err != nil {
+		return ee.New(err, "failed to start new process")
+	}
+	go cmd.Wait() // Reap the child if it exits before we do
+
+	// Close our copy of the write end, so that we see EOF if the child exits
+	// without ever reporting that it is ready.
+	readyW.Close()
+
+	readyR.SetReadDeadline(time.Now().Add(timeout))
+	var buf [1]byte
+	if _, err := readyR.Read(buf[:]); err != nil {
+		cmd.Process.Kill()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return ee.New(err, "new process did not become ready within %v", timeout)
+		}
+		return ee.New(err, "new process exited before it was ready")
+	}
+
+	// The new process is using our Unix sockets now, so we must not delete
+	// them when we shut down.
+	for _, nl := range listeners {
+		if ul, ok := nl.Listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+
+	return nil
+}
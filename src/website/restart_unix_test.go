@@ -0,0 +1,41 @@
+//go:build unix
+
+package website
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignals(t *testing.T) {
+	restart := make(chan os.Signal, 1)
+	reopen := make(chan os.Signal, 1)
+	notifyRestartSignals(restart)
+	notifyReopenLogSignals(reopen)
+	defer signal.Stop(restart)
+	defer signal.Stop(reopen)
+
+	received := func(c chan os.Signal) os.Signal {
+		select {
+		case sig := <-c:
+			return sig
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+
+	// SIGHUP reopens log files for logrotate, and does not restart.
+	assert.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	assert.Equal(t, syscall.SIGHUP, received(reopen))
+	assert.Empty(t, restart)
+
+	// SIGUSR2 restarts, and does not reopen log files.
+	assert.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGUSR2))
+	assert.Equal(t, syscall.SIGUSR2, received(restart))
+	assert.Empty(t, reopen)
+}
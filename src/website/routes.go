@@ -1,48 +1,65 @@
 package website
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"hsf/src/buildcss"
+	"hsf/src/config"
+	"hsf/src/jobs"
 	"hsf/src/logging"
 	"hsf/src/utils"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"path"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
 )
 
-func WebsiteRoutes(tracker *LongRunningRequestTracker) http.Handler {
+func WebsiteRoutes(tracker *LongRunningRequestTracker, accessLog *AccessLogger) http.Handler {
 	router := &Router{}
 	routes := RouteBuilder{
 		Router: router,
 		Middlewares: []Middleware{
 			MiddlewareSetLRRTracker(tracker),
-			MiddlewareRequestLogger,
+			MiddlewareMetrics,
+			MiddlewareAccessLog(accessLog),
+			MiddlewareRecoverPanics,
+			MiddlewareFlash,
 		},
 	}
 
+	// Routes that hijack or proxy the connection must not have a timeout, so
+	// they are registered before the default limits are applied.
+	untimedRoutes := routes
+
+	limits := config.Config.RequestLimits
+	if limits.Timeout > 0 {
+		routes = routes.WithMiddleware(MiddlewareTimeout(limits.Timeout))
+	}
+	if limits.MaxBodySize > 0 {
+		routes = routes.WithMiddleware(MiddlewareMaxBodySize(limits.MaxBodySize))
+	}
+
 	routes.GET(regexp.MustCompile(`^/$`), LandingHTML)
-	routes.GET(regexp.MustCompile(`^/public/.+$`), StaticFiles)
+	untimedRoutes.GET(regexp.MustCompile(`^/public/.+$`), StaticFiles)
 	routes.GET(regexp.MustCompile(`^/long$`), func(c *RequestContext) ResponseData {
 		time.Sleep(time.Second * 15)
 		return ResponseData{StatusCode: http.StatusNoContent}
 	})
-	routes.POST(regexp.MustCompile(`^/hijacked$`), func(c *RequestContext) ResponseData {
-		hj, ok := c.Res.(http.Hijacker)
-		if !ok {
-			return ResponseData{StatusCode: http.StatusInternalServerError}
-		}
-		conn, bufrw := utils.Must2(hj.Hijack())
+	untimedRoutes.POST(regexp.MustCompile(`^/hijacked$`), func(c *RequestContext) ResponseData {
+		conn, bufrw := utils.Must2(c.Hijack())
 		done := c.IsLongRunning()
 
-		go func() {
+		jobs.Go("Hijacked connection", func(job *jobs.Job) error {
 			defer done()
 			defer conn.Close()
 
-			go func() {
+			job.Go(func() error {
 				<-c.LongRunningRequests.Canceled()
 				bufrw.WriteString("HTTP/1.1 200 OK\r\n" +
 					"Content-Type: text/plain; charset=UTF-8\r\n" +
@@ -54,7 +71,8 @@ func WebsiteRoutes(tracker *LongRunningRequestTracker) http.Handler {
 				bufrw.Flush()
 				conn.Close()
 				done()
-			}()
+				return nil
+			})
 
 			s, err := bufrw.ReadString('\n')
 			if err != nil {
@@ -65,7 +83,7 @@ func WebsiteRoutes(tracker *LongRunningRequestTracker) http.Handler {
 					err.Error() + "\r\n" +
 					"\r\n")
 				bufrw.Flush()
-				return
+				return nil
 			}
 			bufrw.WriteString("HTTP/1.1 200 OK\r\n" +
 				"Content-Type: text/html; charset=UTF-8\r\n" +
@@ -76,7 +94,8 @@ func WebsiteRoutes(tracker *LongRunningRequestTracker) http.Handler {
 				"</html>\r\n" +
 				"\r\n")
 			bufrw.Flush()
-		}()
+			return nil
+		})
 
 		return ResponseData{
 			Proxied: true,
@@ -98,20 +117,75 @@ func MiddlewareSetLRRTracker(tracker *LongRunningRequestTracker) Middleware {
 	}
 }
 
-func MiddlewareRequestLogger(h Handler) Handler {
-	return func(c *RequestContext) ResponseData {
-		res := h(c)
+// Converts panics in handlers into 500 responses using the site's normal
+// error page (or the detailed error page in Dev). Panics after the handler has
+// hijacked the connection, or started writing to c.Res itself (e.g. when
+// proxying), are logged, but no response is written.
+func MiddlewareRecoverPanics(h Handler) Handler {
+	return func(c *RequestContext) (res ResponseData) {
+		tracker := &writeTracker{ResponseWriter: c.Res}
+		c.Res = tracker
 
-		duration := time.Now().Sub(c.RequestStartTime)
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
 
-		c.Logger.Info().Msgf("Served [%9s] HTTP:%d %s", duration.String(), res.StatusCode, c.Req.URL.Path)
+			err := panicError(recovered)
+			logger := c.Logger.With().
+				Str("Method", c.Req.Method).
+				Str("Url", ReqFullUrl(c.Req)).
+				Logger()
+			logging.LogPanicValue(&logger, err, "request panicked")
+			reportError(c, err)
+
+			if c.hijacked || tracker.wrote {
+				res = ResponseData{Proxied: true}
+				return
+			}
+			res = renderUnlogged500HTML(c, err)
+		}()
 
-		return res
+		return h(c)
 	}
 }
 
+// Remembers whether anything has been written to a ResponseWriter, after
+// which it's too late to send an error page.
+type writeTracker struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (w *writeTracker) WriteHeader(statusCode int) {
+	w.wrote = true
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *writeTracker) Write(p []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *writeTracker) Flush() {
+	w.wrote = true
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *writeTracker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *writeTracker) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func LandingHTML(c *RequestContext) ResponseData {
-	return renderHTML(c, "landing", GetBaseData())
+	return renderHTML(c, "landing", GetBaseData(c))
 }
 
 // NOTE(asaf): Static files and EsBuild proxying.
@@ -145,6 +219,7 @@ func StaticFiles(c *RequestContext) ResponseData {
 			return res
 		}
 	}
-	http.StripPrefix("/public/", http.FileServer(http.Dir("public"))).ServeHTTP(&res, c.Req)
-	return res
+	// Cleaning the path as if it were rooted prevents any escape from public/
+	publicPath := path.Clean("/" + strings.TrimPrefix(c.Req.URL.Path, "/public/"))
+	return c.ServeFile(filepath.Join("public", filepath.FromSlash(publicPath)), ContentOptions{})
 }
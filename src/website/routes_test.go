@@ -0,0 +1,48 @@
+package website
+
+import (
+	"hsf/src/templates"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddlewareRecoverPanics(t *testing.T) {
+	templates.LoadEmbedded()
+
+	t.Run("renders error page", func(t *testing.T) {
+		res := MiddlewareRecoverPanics(func(c *RequestContext) ResponseData {
+			panic("oh no")
+		})(newTestContext(http.MethodGet, nil))
+		assert.Equal(t, http.StatusInternalServerError, res.StatusCode)
+		assert.NotZero(t, res.Body.Len())
+	})
+	t.Run("leaves hijacked connections alone", func(t *testing.T) {
+		c := newTestContext(http.MethodGet, nil)
+		res := MiddlewareRecoverPanics(func(c *RequestContext) ResponseData {
+			c.hijacked = true
+			panic("oh no")
+		})(c)
+		assert.True(t, res.Proxied)
+	})
+	t.Run("leaves partly written responses alone", func(t *testing.T) {
+		c := newTestContext(http.MethodGet, nil)
+		rec := c.Res.(*httptest.ResponseRecorder)
+		res := MiddlewareRecoverPanics(func(c *RequestContext) ResponseData {
+			c.Res.WriteHeader(http.StatusOK)
+			c.Res.Write([]byte("partial"))
+			panic("oh no")
+		})(c)
+		assert.True(t, res.Proxied)
+		assert.Equal(t, "partial", rec.Body.String())
+	})
+	t.Run("lets aborts through", func(t *testing.T) {
+		assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+			MiddlewareRecoverPanics(func(c *RequestContext) ResponseData {
+				panic(http.ErrAbortHandler)
+			})(newTestContext(http.MethodGet, nil))
+		})
+	})
+}
@@ -0,0 +1,143 @@
+package website
+
+import (
+	"context"
+	"hsf/src/config"
+	"hsf/src/jobs"
+	"hsf/src/logging"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Graceful shutdown happens in phases, each with its own timeout from
+ * config.Config.Shutdown:
+ *
+ * 1. Stop accepting connections. The servers close their listeners and start
+ *    closing idle keep-alive connections.
+ * 2. Cancel long-running requests (websockets et. al.) and wait for them to
+ *    wrap up.
+ * 3. Drain HTTP: wait for in-flight requests to finish. Connections still open
+ *    when the timeout expires are closed forcibly.
+ * 4. Stop background jobs. This happens after requests have drained, since
+ *    requests may depend on them.
+ * 5. Flush logs.
+ *
+ * At the end, a report is logged listing anything that had to be abandoned.
+ */
+
+type shutdownSequence struct {
+	Cfg                 config.ShutdownConfig
+	Servers             []*http.Server
+	Conns               *connCounter
+	LongRunningRequests *LongRunningRequestTracker
+	Jobs                jobs.Jobs
+}
+
+type shutdownReport struct {
+	Duration                     time.Duration
+	AbandonedLongRunningRequests int
+	AbandonedConnections         int
+	UnfinishedJobs               []string
+}
+
+func (s *shutdownSequence) Run() shutdownReport {
+	start := time.Now()
+	var report shutdownReport
+
+	logging.Info().Msg("Shutdown: no longer accepting connections")
+	drainCtx, cancelDrain := context.WithCancel(context.Background())
+	defer cancelDrain()
+	drained := make(chan struct{})
+	go func() {
+		done := make(chan struct{}, len(s.Servers))
+		for _, server := range s.Servers {
+			go func(server *http.Server) {
+				server.Shutdown(drainCtx)
+				done <- struct{}{}
+			}(server)
+		}
+		for range s.Servers {
+			<-done
+		}
+		close(drained)
+	}()
+
+	logging.Info().Msg("Shutdown: canceling long-running requests")
+	s.LongRunningRequests.Cancel()
+	report.AbandonedLongRunningRequests = s.LongRunningRequests.Wait(s.Cfg.LongRunningRequestsTimeout)
+
+	logging.Info().Msg("Shutdown: waiting for in-flight requests")
+	drainTimer := time.NewTimer(s.Cfg.HTTPDrainTimeout)
+	select {
+	case <-drained:
+		drainTimer.Stop()
+	case <-drainTimer.C:
+		report.AbandonedConnections = s.Conns.Open()
+		cancelDrain()
+		for _, server := range s.Servers {
+			server.Close()
+		}
+	}
+
+	logging.Info().Msg("Shutdown: stopping background jobs")
+	report.UnfinishedJobs = s.Jobs.CancelAndWait(s.Cfg.JobsTimeout)
+
+	report.Duration = time.Since(start)
+	report.Log()
+
+	logging.Flush()
+
+	return report
+}
+
+// Describes what is still running. Used when the user gets impatient and
+// forces the process to quit in the middle of the shutdown sequence.
+func (s *shutdownSequence) Unfinished() shutdownReport {
+	return shutdownReport{
+		AbandonedLongRunningRequests: s.LongRunningRequests.Running(),
+		AbandonedConnections:         s.Conns.Open(),
+		UnfinishedJobs:               s.Jobs.ListUnfinished(),
+	}
+}
+
+func (r shutdownReport) Clean() bool {
+	return r.AbandonedLongRunningRequests == 0 && r.AbandonedConnections == 0 && len(r.UnfinishedJobs) == 0
+}
+
+func (r shutdownReport) Log() {
+	var e = logging.Info()
+	msg := "Shut down gracefully"
+	if !r.Clean() {
+		e = logging.Warn()
+		msg = "Shut down, but some work was abandoned"
+	}
+
+	e.
+		Dur("Duration", r.Duration).
+		Int("Abandoned long-running requests", r.AbandonedLongRunningRequests).
+		Int("Abandoned connections", r.AbandonedConnections).
+		Strs("Unfinished background jobs", r.UnfinishedJobs).
+		Msg(msg)
+}
+
+// Counts open connections on an http.Server via its ConnState hook, so that
+// we can report how many were cut off by a forced shutdown.
+type connCounter struct {
+	open atomic.Int64
+}
+
+func (c *connCounter) ConnState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		c.open.Add(1)
+	case http.StateHijacked, http.StateClosed:
+		c.open.Add(-1)
+	}
+}
+
+func (c *connCounter) Open() int {
+	return int(c.open.Load())
+}
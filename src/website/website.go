@@ -1,97 +1,259 @@
 package website
 
 import (
-	"context"
+	"crypto/tls"
 	"errors"
 	"hsf/src/buildcss"
+	"hsf/src/certs"
 	"hsf/src/config"
+	"hsf/src/errreport"
 	"hsf/src/jobs"
 	"hsf/src/logging"
 	"hsf/src/templates"
+	"hsf/src/utils"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"sync"
+	"syscall"
 	"time"
+
+	"github.com/rs/zerolog"
 )
 
+// Signals that start a graceful shutdown. Sending one a second time quits
+// immediately. SIGTERM is what systemd and container runtimes send.
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT}
+
 func Start() {
 	logging.Info().Msg("Starting HSF webserver")
 
 	templates.LoadEmbedded()
 
-	var wg sync.WaitGroup
+	// Load TLS certificates, if we are serving HTTPS ourselves
+	tlsCfg := config.Config.TLS
+	var certReloader *certs.Reloader
+	if tlsCfg.Enabled() {
+		certReloader = utils.Must1(certs.NewReloader(tlsCfg.CertFile, tlsCfg.KeyFile))
+	}
+
+	errreport.Default = errreport.NewFromConfig(config.Config.ErrorReports)
 
 	// Start background jobs
-	wg.Add(1)
 	backgroundJobs := jobs.Jobs{
 		templates.WatchTemplates(),
 		buildcss.RunServer(),
+		errreport.Default.Start(),
+	}
+	if certReloader != nil {
+		backgroundJobs = append(backgroundJobs, certReloader.Watch())
 	}
 
 	// Create tracker for long-running requests
-	wg.Add(1)
 	lrrTracker := NewLongRunningRequestTracker()
 
+	accessLog := utils.Must1(NewAccessLogger(config.Config.AccessLog))
+
 	// Create HTTP server
-	wg.Add(1)
+	var conns connCounter
+	serverCfg := config.Config.HTTPServer.WithDefaults(config.Config.Env)
+	serverLogger := logging.With().Str("module", "http").Logger()
 	server := http.Server{
 		Addr:    config.Config.WebserverAddr,
-		Handler: WebsiteRoutes(lrrTracker),
+		Handler: WebsiteRoutes(lrrTracker, accessLog),
+
+		ReadHeaderTimeout: serverCfg.ReadHeaderTimeout,
+		ReadTimeout:       serverCfg.ReadTimeout,
+		WriteTimeout:      serverCfg.WriteTimeout,
+		IdleTimeout:       serverCfg.IdleTimeout,
+		MaxHeaderBytes:    serverCfg.MaxHeaderBytes,
+		ErrorLog:          logging.NewStdLogger(&serverLogger, zerolog.WarnLevel),
+		ConnState:         conns.ConnState,
+	}
+	servers := []*http.Server{&server}
+	if certReloader != nil {
+		minVersion := tlsCfg.MinVersion
+		if minVersion == 0 {
+			minVersion = tls.VersionTLS12
+		}
+		server.TLSConfig = &tls.Config{
+			MinVersion:     minVersion,
+			GetCertificate: certReloader.GetCertificate,
+		}
 	}
+	// Listeners are kept track of so that they can be passed on to a new
+	// process when restarting.
+	var listeners []namedListener
+	listener := utils.Must1(listen("website", server.Addr, serverCfg.UnixSocketMode))
+	listeners = append(listeners, namedListener{"website", listener})
 	go func() {
-		logging.Info().Str("Address", server.Addr).Msg("Serving HSF website")
-		serverErr := server.ListenAndServe()
+		var serverErr error
+		if certReloader != nil {
+			logging.Info().Str("Address", server.Addr).Msg("Serving HSF website over HTTPS")
+			serverErr = server.ServeTLS(listener, "", "")
+		} else {
+			logging.Info().Str("Address", server.Addr).Msg("Serving HSF website")
+			serverErr = server.Serve(listener)
+		}
 		if !errors.Is(serverErr, http.ErrServerClosed) {
 			logging.Error().Err(serverErr).Msg("Server shut down unexpectedly")
 		}
-		// The wg.Done() happens in the shutdown logic below.
 	}()
 
-	// Wait for SIGINT in the background and gracefully shut down
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt)
-	go func() {
-		<-signals // First SIGINT (start shutdown)
-		logging.Info().Msg("Shutting down...")
-
-		const timeout = 10 * time.Second
-
-		// Cancel long-running requests (allowing websockets et. al. to close)
-		lrrTracker.Cancel()
+	// Redirect plain HTTP to HTTPS, if requested
+	var redirectServer *http.Server
+	if certReloader != nil && tlsCfg.RedirectAddr != "" {
+		redirectServer = &http.Server{
+			Addr:              tlsCfg.RedirectAddr,
+			Handler:           httpsRedirectHandler(server.Addr),
+			ReadHeaderTimeout: serverCfg.ReadHeaderTimeout,
+			IdleTimeout:       serverCfg.IdleTimeout,
+			MaxHeaderBytes:    serverCfg.MaxHeaderBytes,
+			ErrorLog:          logging.NewStdLogger(&serverLogger, zerolog.WarnLevel),
+		}
+		servers = append(servers, redirectServer)
+		redirectListener := utils.Must1(listen("https-redirect", redirectServer.Addr, serverCfg.UnixSocketMode))
+		listeners = append(listeners, namedListener{"https-redirect", redirectListener})
 		go func() {
-			lrrTracker.Wait(timeout)
-			wg.Done()
+			logging.Info().Str("Address", redirectServer.Addr).Msg("Redirecting HTTP to HTTPS")
+			serverErr := redirectServer.Serve(redirectListener)
+			if !errors.Is(serverErr, http.ErrServerClosed) {
+				logging.Error().Err(serverErr).Msg("HTTPS redirect server shut down unexpectedly")
+			}
 		}()
+	}
 
-		// Shut down background jobs
+	// Start the admin server. It is not part of the shutdown sequence, so that
+	// health checks keep working (and report that we are shutting down) until
+	// the very end.
+	status := &serverStatus{
+		StartTime:           time.Now(),
+		LongRunningRequests: lrrTracker,
+		Conns:               &conns,
+		Jobs:                backgroundJobs,
+	}
+	registerServerMetrics(status)
+	var adminServer *http.Server
+	if config.Config.Admin.Addr != "" {
+		adminServer = &http.Server{
+			Addr:              config.Config.Admin.Addr,
+			Handler:           AdminRoutes(status),
+			ReadHeaderTimeout: serverCfg.ReadHeaderTimeout,
+			IdleTimeout:       serverCfg.IdleTimeout,
+			MaxHeaderBytes:    serverCfg.MaxHeaderBytes,
+			ErrorLog:          logging.NewStdLogger(&serverLogger, zerolog.WarnLevel),
+		}
+		adminListener := utils.Must1(listen("admin", adminServer.Addr, serverCfg.UnixSocketMode))
+		listeners = append(listeners, namedListener{"admin", adminListener})
 		go func() {
-			logging.Info().Msg("Shutting down background jobs...")
-			unfinished := backgroundJobs.CancelAndWait(10 * time.Second)
-			if len(unfinished) == 0 {
-				logging.Info().Msg("Background jobs closed gracefully")
-			} else {
-				logging.Warn().Strs("Unfinished", unfinished).Msg("Background jobs did not finish by the deadline")
+			logging.Info().Str("Address", adminServer.Addr).Msg("Serving admin endpoints")
+			serverErr := adminServer.Serve(adminListener)
+			if !errors.Is(serverErr, http.ErrServerClosed) {
+				logging.Error().Err(serverErr).Msg("Admin server shut down unexpectedly")
 			}
-			wg.Done()
 		}()
+	}
 
-		// Gracefully shut down the HTTP server
-		go func() {
-			timeoutCtx, cancel := context.WithTimeout(context.Background(), timeout)
-			defer cancel()
-			err := server.Shutdown(timeoutCtx)
+	// Let a parent process know that it can hand over to us (see listeners.go)
+	notifyReady()
+
+	// On SIGHUP, reopen log files (see config.LogFileConfig)
+	reopenSignals := make(chan os.Signal, 1)
+	notifyReopenLogSignals(reopenSignals)
+	go func() {
+		for range reopenSignals {
+			if err := logging.ReopenFiles(); err != nil {
+				logging.Error().Err(err).Msg("Failed to reopen log file")
+			}
+			if err := accessLog.Reopen(); err != nil {
+				logging.Error().Err(err).Msg("Failed to reopen access log")
+			}
+			logging.Info().Msg("Reopened log files")
+		}
+	}()
+
+	// On SIGUSR2, start a new copy of the server with our listeners and then
+	// shut down gracefully.
+	handedOff := make(chan struct{})
+	restartSignals := make(chan os.Signal, 1)
+	notifyRestartSignals(restartSignals)
+	go func() {
+		for range restartSignals {
+			logging.Info().Msg("Starting new process for restart...")
+			err := startReplacementProcess(listeners, 30*time.Second)
 			if err != nil {
-				logging.Warn().Err(err).Msg("Server did not shut down gracefully")
+				logging.Error().Err(err).Msg("Failed to restart; continuing to serve")
+				continue
 			}
-			wg.Done()
+			signal.Stop(restartSignals)
+			close(handedOff)
+			return
+		}
+	}()
+
+	// Wait for SIGINT or SIGTERM in the background and gracefully shut down
+	shutdown := shutdownSequence{
+		Cfg:                 config.Config.Shutdown.WithDefaults(),
+		Servers:             servers,
+		Conns:               &conns,
+		LongRunningRequests: lrrTracker,
+		Jobs:                backgroundJobs,
+	}
+	shutdownComplete := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, shutdownSignals...)
+	go func() {
+		select {
+		case sig := <-signals: // First signal (start shutdown)
+			logging.Info().Str("Signal", sig.String()).Msg("Shutting down...")
+		case <-handedOff:
+			logging.Info().Msg("New process is serving; shutting down the old one...")
+		}
+
+		status.ShuttingDown.Store(true)
+		go func() {
+			shutdown.Run()
+			accessLog.Close()
+			if adminServer != nil {
+				adminServer.Close()
+			}
+			close(shutdownComplete)
 		}()
 
-		<-signals // Second SIGINT (force quit)
-		logging.Warn().Strs("Unfinished background jobs", backgroundJobs.ListUnfinished()).Msg("Forcibly killed the website")
+		<-signals // Second signal (force quit)
+		report := shutdown.Unfinished()
+		logging.Warn().
+			Int("Abandoned long-running requests", report.AbandonedLongRunningRequests).
+			Int("Abandoned connections", report.AbandonedConnections).
+			Strs("Unfinished background jobs", report.UnfinishedJobs).
+			Msg("Forcibly killed the website")
+		logging.Flush()
 		os.Exit(1)
 	}()
 
 	// Wait for all of the above to finish, then exit
-	wg.Wait()
+	<-shutdownComplete
+}
+
+// Redirects every request to the same URL on the HTTPS server listening at
+// httpsAddr.
+func httpsRedirectHandler(httpsAddr string) http.Handler {
+	_, httpsPort, _ := net.SplitHostPort(httpsAddr)
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+
+		code := http.StatusMovedPermanently
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			// Make sure the browser repeats the request with the same method
+			code = http.StatusPermanentRedirect
+		}
+		http.Redirect(rw, req, "https://"+host+req.URL.RequestURI(), code)
+	})
 }